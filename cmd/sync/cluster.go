@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/yzxiu/calico-route-sync/pkg/route"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// apiServerTimeout apiServerRetry the timeout of a reachability check of the apiserver and the pause between two
+	apiServerTimeout = 10 * time.Second
+	apiServerRetry   = 5 * time.Second
+)
+
+// waitForAPIServer wait until the apiserver answers, the routes of the state file are restored
+// as soon as it can not be reached. False when stopped before
+func waitForAPIServer(restConfig *rest.Config, router *route.Router, stopCh <-chan struct{}) bool {
+	probeConfig := rest.CopyConfig(restConfig)
+	probeConfig.Timeout = apiServerTimeout
+	client, err := discovery.NewDiscoveryClientForConfig(probeConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		return true
+	}
+	restored := false
+	err = wait.PollImmediateUntil(apiServerRetry, func() (bool, error) {
+		if _, err := client.ServerVersion(); err != nil {
+			setupLog.Error(err, "apiserver unreachable, retrying", "retry", apiServerRetry)
+			if !restored {
+				restored = true
+				count, err := router.RestoreState()
+				if err != nil {
+					setupLog.Error(err, "unable to restore the routes of the state file")
+				} else {
+					setupLog.Info("restored the routes of the state file", "routes", count)
+				}
+			}
+			return false, nil
+		}
+		return true, nil
+	}, stopCh)
+	return err == nil
+}
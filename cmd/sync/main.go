@@ -3,22 +3,29 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/config"
 	"github.com/yzxiu/calico-route-sync/pkg/controllers"
 	"github.com/yzxiu/calico-route-sync/pkg/route"
 	"github.com/yzxiu/calico-route-sync/pkg/util"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"net/http"
 	"os"
-	"time"
+	"strconv"
 
+	uberzap "go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 var (
@@ -38,20 +45,71 @@ var (
 
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
+	klog.InitFlags(klogFlags)
+}
+
+// klogFlags the klog flags, set from the log level rather than the command line
+var klogFlags = flag.NewFlagSet("klog", flag.ContinueOnError)
+
+func setKlogVerbosity(v int) error {
+	return klogFlags.Set("v", strconv.Itoa(v))
 }
 
 func main() {
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "Path of the YAML or JSON config file, reloaded on SIGHUP. The flags set on the command line override its values.")
+	config.Default().BindFlags(flag.CommandLine)
 
 	flag.Parse()
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	cfg, err := config.Load(configFile, flag.CommandLine)
+	if err != nil {
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	level, _ := cfg.Logging.ZapLevel()
+	logLevel := uberzap.NewAtomicLevelAt(level)
+	ctrl.SetLogger(zap.New(zap.UseDevMode(cfg.Logging.Development), zap.Level(logLevel)))
+	// the route package logs through klog, into the same logger
+	klog.SetLogger(ctrl.Log.WithName("route"))
+	if err = setKlogVerbosity(cfg.Logging.KlogVerbosity()); err != nil {
+		setupLog.Error(err, "unable to set the klog verbosity")
+		os.Exit(1)
+	}
+	settings, _ := cfg.Settings()
+	settingsStore := controllers.NewSettingsStore(settings)
 
 	stopCh := ctrl.SetupSignalHandler().Done()
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		LeaderElection:     false,
-		MetricsBindAddress: "0",
-		Scheme:             scheme,
-		Port:               9443,
+	// localNetwork
+	localNetworks, err := util.LocalNetworks()
+	if err != nil {
+		setupLog.Error(err, "unable to get local network")
+		os.Exit(1)
+	}
+	router, err := route.NewRouter(localNetworks, cfg.RouteOptions())
+	if err != nil {
+		setupLog.Error(err, "unable to create router")
+		os.Exit(1)
+	}
+	if err = router.EnsureTunnels(); err != nil {
+		setupLog.Error(err, "unable to set up tunnel devices")
+		os.Exit(1)
+	}
+
+	// nothing is deleted until the first full sync made with a consistent view of the cluster
+	router.Freeze("no full sync yet")
+	restConfig := ctrl.GetConfigOrDie()
+	if !waitForAPIServer(restConfig, router, stopCh) {
+		os.Exit(0)
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		LeaderElection:         false,
+		MetricsBindAddress:     cfg.Endpoints.Metrics,
+		HealthProbeBindAddress: cfg.Endpoints.Health,
+		Scheme:                 scheme,
+		Port:                   cfg.Endpoints.WebhookPort,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -69,43 +127,154 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
-	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 5*time.Minute)
+	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, cfg.Intervals.Resync.Duration)
 	ippoolInformer := dynamicFactory.ForResource(IpPoolResource)
 	nodeInformer := dynamicFactory.ForResource(NodeResource)
+	// the routes of the filtered out pools are out of scope, they are never listed
+	ippoolLister := controllers.FilterPools(ippoolInformer.Lister(), settingsStore)
+	watches := &controllers.WatchMonitor{}
+	for resource, informer := range map[string]cache.SharedIndexInformer{
+		IpPoolResource.Resource: ippoolInformer.Informer(),
+		NodeResource.Resource:   nodeInformer.Informer(),
+	} {
+		if err = watches.Monitor(informer, resource); err != nil {
+			setupLog.Error(err, "unable to monitor watch", "resource", resource)
+			os.Exit(1)
+		}
+	}
 	dynamicFactory.Start(stopCh)
+	// the informers retry until the apiserver answers, only the stop interrupts the wait
 	for gvr, ok := range dynamicFactory.WaitForCacheSync(stopCh) {
 		if !ok {
-			panic(fmt.Sprintf("Failed to sync cache for resource %v", gvr))
+			setupLog.Info("stopped before the cache synced", "resource", gvr.String())
+			os.Exit(0)
 		}
 	}
 
-	// localNetwork
-	localNetworks, err := util.LocalNetworks()
-	if err != nil {
-		setupLog.Error(err, "unable to get local network")
+	if err = mgr.Add(manager.RunnableFunc(router.WatchRoutes)); err != nil {
+		setupLog.Error(err, "unable to add route watcher")
+		os.Exit(1)
+	}
+	if err = mgr.Add(manager.RunnableFunc(router.WatchLocalNetworks)); err != nil {
+		setupLog.Error(err, "unable to add local network watcher")
 		os.Exit(1)
 	}
-	router, err := route.NewRouter(localNetworks)
 
+	// the IPPool controller triggers the BlockAffinity controller
+	poolEvents := make(chan event.GenericEvent)
 	r := &controllers.BlockAffinityReconciler{
 		Client:       mgr.GetClient(),
 		Log:          ctrl.Log.WithName("controllers").WithName("BlockAffinity"),
 		Scheme:       mgr.GetScheme(),
 		NodeLister:   nodeInformer.Lister(),
-		IpPoolLister: ippoolInformer.Lister(),
+		NodeInformer: nodeInformer.Informer(),
+		IpPoolLister: ippoolLister,
 		Router:       router,
+		Settings:     settingsStore,
+		PoolEvents:   poolEvents,
 	}
 	if err = r.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "blockaffinity")
 		os.Exit(1)
 	}
+	// the first full sync installs the routes of all the BlockAffinities at once
+	r.DeferToFullSync()
+	// the routes kept by the previous run are reconciled in place, never deleted and re-added
+	if err = r.AdoptCalicoRoutes(); err != nil {
+		setupLog.Error(err, "unable to adopt the routes of the previous run")
+	}
+	var br *controllers.IPAMBlockReconciler
+	if cfg.BorrowedIPRoutes {
+		br = &controllers.IPAMBlockReconciler{
+			Client:         mgr.GetClient(),
+			Log:            ctrl.Log.WithName("controllers").WithName("IPAMBlock"),
+			NodeLister:     nodeInformer.Lister(),
+			NodeInformer:   nodeInformer.Informer(),
+			IpPoolLister:   ippoolLister,
+			IpPoolInformer: ippoolInformer.Informer(),
+			Router:         router,
+			Settings:       settingsStore,
+		}
+		if err = br.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ipamblock")
+			os.Exit(1)
+		}
+	}
+	// the full sync deletes the routes missing from the cache, which must follow the cluster
+	monitored := map[string]client.Object{"blockaffinities": &calico.BlockAffinity{}}
+	if br != nil {
+		monitored["ipamblocks"] = &calico.IPAMBlock{}
+	}
+	for resource, obj := range monitored {
+		if err = watches.MonitorCache(context.Background(), mgr.GetCache(), obj, resource); err != nil {
+			setupLog.Error(err, "unable to monitor watch", "resource", resource)
+			os.Exit(1)
+		}
+	}
+	syncer := &controllers.Syncer{
+		Reconciler: r,
+		Borrowed:   br,
+		AllPools:   ippoolInformer.Lister(),
+		Cache:      mgr.GetCache(),
+		Interval:   cfg.Intervals.Sync.Duration,
+		Log:        ctrl.Log.WithName("controllers").WithName("Syncer"),
+		Watches:    watches,
+	}
+	if err = mgr.Add(syncer); err != nil {
+		setupLog.Error(err, "unable to add full route sync")
+		os.Exit(1)
+	}
+	// ready once the caches are synced and the routes installed by the first full sync
+	if err = mgr.AddReadyzCheck("full-sync", syncer.Ready); err != nil {
+		setupLog.Error(err, "unable to add readiness check")
+		os.Exit(1)
+	}
+	if err = mgr.AddHealthzCheck("sync-loop", syncer.Alive(cfg.Health.StallTimeout.Duration)); err != nil {
+		setupLog.Error(err, "unable to add liveness check")
+		os.Exit(1)
+	}
+	if err = mgr.AddHealthzCheck("watches", func(_ *http.Request) error {
+		return watches.Check(cfg.Health.WatchTimeout.Duration)
+	}); err != nil {
+		setupLog.Error(err, "unable to add liveness check")
+		os.Exit(1)
+	}
+	pr := &controllers.IPPoolReconciler{
+		Client:         mgr.GetClient(),
+		Log:            ctrl.Log.WithName("controllers").WithName("IPPool"),
+		IpPoolLister:   ippoolLister,
+		IpPoolInformer: ippoolInformer.Informer(),
+		Router:         router,
+		BlockEvents:    poolEvents,
+	}
+	if err = pr.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ippool")
+		os.Exit(1)
+	}
+
+	reloader := &reloader{
+		file:     configFile,
+		current:  cfg,
+		logLevel: logLevel,
+		blocks:   r,
+		router:   router,
+		syncer:   syncer,
+	}
+	if err = mgr.Add(reloader); err != nil {
+		setupLog.Error(err, "unable to add config reloader")
+		os.Exit(1)
+	}
 
 	ctx, cancel := context.WithCancel(context.TODO())
 	go func() {
 		<-stopCh
-		setupLog.Info("clean pod route ...")
-		r.CleanCalicoRoutes()
-		setupLog.Info("clean pod route finished ...")
+		if cfg.ShutdownPolicy == config.ShutdownKeep {
+			setupLog.Info("keep pod route ...")
+		} else {
+			setupLog.Info("clean pod route ...")
+			r.CleanCalicoRoutes()
+			setupLog.Info("clean pod route finished ...")
+		}
 		cancel()
 	}()
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/yzxiu/calico-route-sync/pkg/config"
+	"github.com/yzxiu/calico-route-sync/pkg/controllers"
+	"github.com/yzxiu/calico-route-sync/pkg/route"
+	uberzap "go.uber.org/zap"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var reloadLog = ctrl.Log.WithName("reload")
+
+// reloader reload the config file on SIGHUP. The filters, node address selection, sync interval and
+// log level are applied at once and the routes re-reconciled by a full sync, the routes still
+// desired stay in place. The other sections are only applied on restart.
+// SIGUSR1 overrides the tripped delete breaker with an immediate full sync
+type reloader struct {
+	file     string
+	current  *config.Config
+	logLevel uberzap.AtomicLevel
+	blocks   *controllers.BlockAffinityReconciler
+	router   *route.Router
+	syncer   *controllers.Syncer
+}
+
+// Start implements manager.Runnable
+func (l *reloader) Start(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			l.reload()
+		case <-usr1:
+			reloadLog.Info("SIGUSR1 received, override the delete breaker")
+			l.router.OverrideDeleteBreaker()
+			l.syncer.Resync(0)
+		}
+	}
+}
+
+func (l *reloader) reload() {
+	reloadLog.Info("SIGHUP received, reload configuration", "file", l.file)
+	next, err := config.Load(l.file, flag.CommandLine)
+	if err != nil {
+		// keep running with the current configuration
+		reloadLog.Error(err, "invalid configuration, not reloaded")
+		return
+	}
+	if changed := l.current.RestartRequired(next); len(changed) > 0 {
+		reloadLog.Info("changes only applied on restart", "sections", changed)
+	}
+	settings, _ := next.Settings()
+	if err = l.blocks.ApplySettings(settings); err != nil {
+		reloadLog.Error(err, "delete routes of the pools out of scope error")
+	}
+	level, _ := next.Logging.ZapLevel()
+	l.logLevel.SetLevel(level)
+	if err = setKlogVerbosity(next.Logging.KlogVerbosity()); err != nil {
+		reloadLog.Error(err, "set the klog verbosity error")
+	}
+	l.current = next
+	l.syncer.Resync(next.Intervals.Sync.Duration)
+	reloadLog.Info("configuration reloaded")
+}
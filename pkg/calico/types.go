@@ -25,6 +25,29 @@ const (
 
 	KindBlockAffinity     = "BlockAffinity"
 	KindBlockAffinityList = "BlockAffinityList"
+	KindIPAMBlock         = "IPAMBlock"
+	KindIPAMBlockList     = "IPAMBlockList"
+
+	// IPAMBlockAttributeNode the secondary attribute holding the node an address is allocated to
+	IPAMBlockAttributeNode = "node"
+	// IPAMBlockAffinityPrefix prefix of the IPAMBlock affinity of a host
+	IPAMBlockAffinityPrefix = "host:"
+)
+
+// The states of a BlockAffinity
+const (
+	StateConfirmed       = "confirmed"
+	StatePending         = "pending"
+	StatePendingDeletion = "pendingDeletion"
+)
+
+// The annotations calico/node writes onto the Kubernetes Node in KDD mode.
+// The address annotations hold the BGP addresses of the Calico Node resource, in cidr form
+const (
+	AnnotationIPv4Address         = "projectcalico.org/IPv4Address"
+	AnnotationIPv6Address         = "projectcalico.org/IPv6Address"
+	AnnotationIPv4VXLANTunnelAddr = "projectcalico.org/IPv4VXLANTunnelAddr"
+	AnnotationVXLANTunnelMACAddr  = "projectcalico.org/VXLANTunnelMACAddr"
 )
 
 // BlockAffinity maintains a block affinity's state
@@ -79,8 +102,61 @@ func NewBlockAffinityList() *BlockAffinityList {
 	}
 }
 
+// IPAMBlock contains information about a block for IP address assignment.
+type IPAMBlock struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	// Specification of the IPAMBlock.
+	Spec IPAMBlockSpec `json:"spec,omitempty"`
+}
+
+// IPAMBlockSpec contains the specification for an IPAMBlock resource.
+type IPAMBlockSpec struct {
+	// The block's CIDR.
+	CIDR string `json:"cidr"`
+
+	// Affinity of the block, if this block has one. If set, it will be of the form
+	// "host:<hostname>". If not set, this block is not affine to a host.
+	Affinity *string `json:"affinity,omitempty"`
+
+	// Array of allocations in-use within this block. nil entries mean the allocation is free.
+	// For non-nil entries at index i, the index is the ordinal of the allocation within this block
+	// and the value is the index of the associated attributes in the Attributes array.
+	Allocations []*int `json:"allocations"`
+
+	// Unallocated is an ordered list of allocations which are free in the block.
+	Unallocated []int `json:"unallocated"`
+
+	// Attributes is an array of arbitrary metadata associated with allocations in the block. To find
+	// attributes for a given allocation, use the value of the allocation's entry in the Allocations array
+	// as the index of the element in this array.
+	Attributes []AllocationAttribute `json:"attributes"`
+
+	// Deleted is an internal boolean used to workaround a limitation in the Kubernetes API whereby
+	// deletion will not return a conflict error if the block has been updated. It should not be set manually.
+	Deleted bool `json:"deleted"`
+}
+
+// AllocationAttribute the metadata of an allocation, the secondary attributes hold the node,
+// namespace and pod of the address.
+type AllocationAttribute struct {
+	AttrPrimary   *string           `json:"handle_id,omitempty"`
+	AttrSecondary map[string]string `json:"secondary,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPAMBlockList contains a list of IPAMBlock resources.
+type IPAMBlockList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []IPAMBlock `json:"items"`
+}
+
 func init() {
 	SchemeBuilder.Register(&BlockAffinity{}, &BlockAffinityList{})
+	SchemeBuilder.Register(&IPAMBlock{}, &IPAMBlockList{})
 }
 
 type IPPool struct {
@@ -0,0 +1,378 @@
+// Package config the configuration of calico-route-sync, read from a YAML or JSON file
+// and the command line flags, which override the values of the file
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/yzxiu/calico-route-sync/pkg/controllers"
+	"github.com/yzxiu/calico-route-sync/pkg/route"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type Config struct {
+	Route       Route       `json:"route"`
+	Tunnel      Tunnel      `json:"tunnel"`
+	Filters     Filters     `json:"filters"`
+	NodeAddress NodeAddress `json:"nodeAddress"`
+	// EnforcePoolNodeSelector do not route the blocks of the nodes not selected by the nodeSelector of their IPPool
+	EnforcePoolNodeSelector bool `json:"enforcePoolNodeSelector"`
+	// BorrowedIPRoutes route the addresses borrowed from the IPAMBlocks via their hosting node
+	BorrowedIPRoutes bool `json:"borrowedIPRoutes"`
+	// ShutdownPolicy ShutdownClean or ShutdownKeep
+	ShutdownPolicy string `json:"shutdownPolicy"`
+	// StateFile where the last desired routes are persisted, restored when the cluster is unreachable at boot
+	StateFile     string        `json:"stateFile,omitempty"`
+	DeleteBreaker DeleteBreaker `json:"deleteBreaker"`
+	Intervals     Intervals     `json:"intervals"`
+	Logging       Logging       `json:"logging"`
+	Endpoints     Endpoints     `json:"endpoints"`
+	Health        Health        `json:"health"`
+}
+
+// The shutdown policies
+const (
+	// ShutdownClean delete the routes, ip rules and vteps on exit
+	ShutdownClean = "clean"
+	// ShutdownKeep leave everything in place on exit, the next run adopts the routes
+	ShutdownKeep = "keep"
+)
+
+// Route how the routes are marked in the kernel
+type Route struct {
+	Protocol      int  `json:"protocol"`
+	Realm         int  `json:"realm"`
+	Table         int  `json:"table"`
+	RulePriority  int  `json:"rulePriority"`
+	AdoptUnmarked bool `json:"adoptUnmarked"`
+	// DryRun log the planned changes, never touch the kernel
+	DryRun bool `json:"dryRun"`
+}
+
+// Tunnel the encapsulation of the routes
+type Tunnel struct {
+	IPIP      bool `json:"ipip"`
+	IPIPMTU   int  `json:"ipipMTU"`
+	VXLAN     bool `json:"vxlan"`
+	VXLANMTU  int  `json:"vxlanMTU"`
+	VXLANVNI  int  `json:"vxlanVNI"`
+	VXLANPort int  `json:"vxlanPort"`
+}
+
+// Filters which IPPools and nodes are routed
+type Filters struct {
+	IncludePools     []string `json:"includePools,omitempty"`
+	ExcludePools     []string `json:"excludePools,omitempty"`
+	PoolSelector     string   `json:"poolSelector,omitempty"`
+	IncludePoolCIDRs []string `json:"includePoolCIDRs,omitempty"`
+	ExcludePoolCIDRs []string `json:"excludePoolCIDRs,omitempty"`
+	NodeSelector     string   `json:"nodeSelector,omitempty"`
+	IncludeNodes     string   `json:"includeNodes,omitempty"`
+	ExcludeNodes     string   `json:"excludeNodes,omitempty"`
+}
+
+// DeleteBreaker how many managed routes a full sync deletes at once without confirmation, 0 means no limit
+type DeleteBreaker struct {
+	// MaxFraction of the managed routes
+	MaxFraction float64 `json:"maxFraction"`
+	MaxCount    int     `json:"maxCount"`
+}
+
+// NodeAddress how the node address used as gateway is selected
+type NodeAddress struct {
+	Sources     []string `json:"sources"`
+	LocalSubnet bool     `json:"localSubnet"`
+}
+
+type Intervals struct {
+	// Sync interval of the full desired-state route sync
+	Sync metav1.Duration `json:"sync"`
+	// Resync resync period of the node and IPPool informers
+	Resync        metav1.Duration `json:"resync"`
+	DriftDebounce metav1.Duration `json:"driftDebounce"`
+}
+
+type Logging struct {
+	// Level debug, info, warn or error
+	Level       string `json:"level"`
+	Development bool   `json:"development"`
+}
+
+type Endpoints struct {
+	// Metrics bind address of the metrics endpoint, "0" disables it
+	Metrics string `json:"metrics"`
+	// Health bind address of the /healthz and /readyz endpoints, "0" disables it
+	Health      string `json:"health"`
+	WebhookPort int    `json:"webhookPort"`
+}
+
+// Health the thresholds of the liveness check
+type Health struct {
+	// StallTimeout no full sync finished for longer than the sync interval and this is a stall
+	StallTimeout metav1.Duration `json:"stallTimeout"`
+	// WatchTimeout an apiserver watch broken for longer than this is fatal
+	WatchTimeout metav1.Duration `json:"watchTimeout"`
+}
+
+// Default the configuration without file nor flags
+func Default() *Config {
+	return &Config{
+		Route: Route{
+			Protocol:     types.DefaultRouteProtocol,
+			RulePriority: types.DefaultRulePriority,
+		},
+		Tunnel: Tunnel{
+			IPIPMTU:   1480,
+			VXLANMTU:  1450,
+			VXLANVNI:  types.DefaultVXLANVNI,
+			VXLANPort: types.DefaultVXLANPort,
+		},
+		NodeAddress: NodeAddress{
+			Sources: append([]string(nil), util.DefaultAddressSources...),
+		},
+		ShutdownPolicy: ShutdownClean,
+		DeleteBreaker: DeleteBreaker{
+			MaxFraction: 0.5,
+		},
+		Intervals: Intervals{
+			Sync:          metav1.Duration{Duration: time.Minute},
+			Resync:        metav1.Duration{Duration: 5 * time.Minute},
+			DriftDebounce: metav1.Duration{Duration: 2 * time.Second},
+		},
+		Logging: Logging{
+			Level:       "info",
+			Development: true,
+		},
+		Endpoints: Endpoints{
+			Metrics:     ":9090",
+			Health:      ":9091",
+			WebhookPort: 9443,
+		},
+		Health: Health{
+			StallTimeout: metav1.Duration{Duration: 5 * time.Minute},
+			WatchTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		},
+	}
+}
+
+// Load read the file (if any) over the defaults, the flags set on the command line win
+func Load(path string, cmdline *flag.FlagSet) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %s: %v", path, err)
+		}
+	}
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	cfg.BindFlags(fs)
+	var err error
+	cmdline.Visit(func(f *flag.Flag) {
+		if err == nil && fs.Lookup(f.Name) != nil {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// BindFlags register the command line flags setting the fields of the config
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Route.Protocol, "route-protocol", c.Route.Protocol, "The rtnetlink protocol used to mark the routes installed by calico-route-sync, only routes carrying it are ever modified or deleted.")
+	fs.IntVar(&c.Route.Realm, "route-realm", c.Route.Realm, "Optional route realm set on the installed routes, 0 means unset.")
+	fs.IntVar(&c.Route.Table, "route-table", c.Route.Table, "The routing table the routes are installed into, 0 means the main table. A dedicated table is looked up through an ip rule per IPPool cidr.")
+	fs.IntVar(&c.Route.RulePriority, "rule-priority", c.Route.RulePriority, "The priority of the ip rules looking up a dedicated route table.")
+	fs.BoolVar(&c.Route.AdoptUnmarked, "adopt-unmarked-routes", c.Route.AdoptUnmarked, "Take over pre-existing pod routes without the protocol marker (proto boot/static), e.g. routes installed by older versions.")
+	fs.BoolVar(&c.Route.DryRun, "dry-run", c.Route.DryRun, "Only log and count the route, ip rule and tunnel changes which would be made, never change the kernel state.")
+	fs.StringVar(&c.ShutdownPolicy, "shutdown-policy", c.ShutdownPolicy, "What is done with the routes on exit: \"clean\" deletes them, \"keep\" leaves them in place for the next run to adopt, e.g. for hitless restarts and upgrades.")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "Where the desired routes of the last full sync are persisted, they are restored when the apiserver can not be reached at boot. Empty disables it.")
+	fs.Float64Var(&c.DeleteBreaker.MaxFraction, "max-delete-fraction", c.DeleteBreaker.MaxFraction, "The largest fraction of the managed routes a full sync deletes at once, more waits for the next full sync to confirm the deletes or for SIGUSR1. 0 means no limit.")
+	fs.IntVar(&c.DeleteBreaker.MaxCount, "max-delete-count", c.DeleteBreaker.MaxCount, "The most managed routes a full sync deletes at once, more waits for the next full sync to confirm the deletes or for SIGUSR1. 0 means no limit.")
+	fs.DurationVar(&c.Intervals.DriftDebounce.Duration, "drift-debounce", c.Intervals.DriftDebounce.Duration, "How long a pod route changed or deleted by others must stay quiet before it is repaired.")
+	fs.DurationVar(&c.Intervals.Sync.Duration, "sync-interval", c.Intervals.Sync.Duration, "The interval of the full desired-state route sync.")
+	fs.DurationVar(&c.Intervals.Resync.Duration, "resync-period", c.Intervals.Resync.Duration, "The resync period of the node and IPPool informers.")
+	fs.BoolVar(&c.Tunnel.IPIP, "ipip", c.Tunnel.IPIP, "Route the blocks of the IPPools with IPIPMode Always/CrossSubnet through the "+types.IpIpLink+" ipip tunnel device when required by the pool.")
+	fs.IntVar(&c.Tunnel.IPIPMTU, "ipip-mtu", c.Tunnel.IPIPMTU, "The mtu of the ipip tunnel device.")
+	fs.BoolVar(&c.Tunnel.VXLAN, "vxlan", c.Tunnel.VXLAN, "Join Calico's vxlan overlay: route the blocks of the IPPools with VXLANMode Always/CrossSubnet through the "+types.VXLANLink+" device when required by the pool.")
+	fs.IntVar(&c.Tunnel.VXLANMTU, "vxlan-mtu", c.Tunnel.VXLANMTU, "The mtu of the vxlan device.")
+	fs.IntVar(&c.Tunnel.VXLANVNI, "vxlan-vni", c.Tunnel.VXLANVNI, "The vni of Calico's vxlan overlay.")
+	fs.IntVar(&c.Tunnel.VXLANPort, "vxlan-port", c.Tunnel.VXLANPort, "The udp port of Calico's vxlan overlay.")
+	fs.Var((*stringList)(&c.NodeAddress.Sources), "node-address-sources", "Ordered list of the sources of the node address used as gateway: \""+util.AddressSourceCalico+"\" (the projectcalico.org/IPv4Address and IPv6Address annotations of the Kubernetes node) and the Kubernetes node address types (InternalIP, ExternalIP, ...).")
+	fs.BoolVar(&c.NodeAddress.LocalSubnet, "node-address-local-subnet", c.NodeAddress.LocalSubnet, "Prefer the node address inside one of the local subnets, whatever its source.")
+	fs.BoolVar(&c.EnforcePoolNodeSelector, "enforce-pool-node-selector", c.EnforcePoolNodeSelector, "Do not route the blocks of the nodes no longer selected by the nodeSelector of their IPPool, instead of only flagging them.")
+	fs.Var((*stringList)(&c.Filters.IncludePools), "include-pools", "Comma separated names of the only IPPools to route, empty means all.")
+	fs.Var((*stringList)(&c.Filters.ExcludePools), "exclude-pools", "Comma separated names of the IPPools not to route.")
+	fs.StringVar(&c.Filters.PoolSelector, "pool-selector", c.Filters.PoolSelector, "Label selector of the IPPools to route, empty means all.")
+	fs.Var((*stringList)(&c.Filters.IncludePoolCIDRs), "include-pool-cidrs", "Comma separated cidrs, only the IPPools inside one of them are routed, empty means all.")
+	fs.Var((*stringList)(&c.Filters.ExcludePoolCIDRs), "exclude-pool-cidrs", "Comma separated cidrs, the IPPools inside one of them are not routed.")
+	fs.StringVar(&c.Filters.NodeSelector, "node-selector", c.Filters.NodeSelector, "Label selector of the nodes whose blocks are routed, empty means all.")
+	fs.StringVar(&c.Filters.IncludeNodes, "include-nodes", c.Filters.IncludeNodes, "Regexp matching the names of the nodes whose blocks are routed, empty means all.")
+	fs.StringVar(&c.Filters.ExcludeNodes, "exclude-nodes", c.Filters.ExcludeNodes, "Regexp matching the names of the nodes whose blocks are not routed.")
+	fs.BoolVar(&c.BorrowedIPRoutes, "borrowed-ip-routes", c.BorrowedIPRoutes, "Install /32 (/128) routes via the hosting node for the addresses a node borrowed from an IPAMBlock affine to another node.")
+	fs.StringVar(&c.Logging.Level, "log-level", c.Logging.Level, "The log level: debug, info, warn or error.")
+	fs.BoolVar(&c.Logging.Development, "log-development", c.Logging.Development, "Log in the human readable development format instead of json.")
+	fs.StringVar(&c.Endpoints.Metrics, "metrics-bind-address", c.Endpoints.Metrics, "The address the metrics endpoint binds to, e.g. 127.0.0.1:9090 to only serve the local host, \"0\" disables it.")
+	fs.StringVar(&c.Endpoints.Health, "health-probe-bind-address", c.Endpoints.Health, "The address the /healthz and /readyz endpoints bind to, \"0\" disables them.")
+	fs.DurationVar(&c.Health.StallTimeout.Duration, "stall-timeout", c.Health.StallTimeout.Duration, "The liveness check fails when no full sync finished for longer than the sync interval and this timeout.")
+	fs.DurationVar(&c.Health.WatchTimeout.Duration, "watch-timeout", c.Health.WatchTimeout.Duration, "The liveness check fails when an apiserver watch is broken for longer than this timeout.")
+	fs.IntVar(&c.Endpoints.WebhookPort, "webhook-port", c.Endpoints.WebhookPort, "The port of the webhook server.")
+}
+
+// Validate check the whole configuration is usable
+func (c *Config) Validate() error {
+	if err := c.RouteOptions().Validate(); err != nil {
+		return err
+	}
+	if _, err := c.Settings(); err != nil {
+		return err
+	}
+	if c.ShutdownPolicy != ShutdownClean && c.ShutdownPolicy != ShutdownKeep {
+		return fmt.Errorf("invalid shutdown policy %q, must be %s or %s", c.ShutdownPolicy, ShutdownClean, ShutdownKeep)
+	}
+	if c.Intervals.Sync.Duration <= 0 {
+		return fmt.Errorf("invalid sync interval %s", c.Intervals.Sync.Duration)
+	}
+	if c.Intervals.Resync.Duration < 0 {
+		return fmt.Errorf("invalid resync period %s", c.Intervals.Resync.Duration)
+	}
+	if c.Health.StallTimeout.Duration <= 0 || c.Health.WatchTimeout.Duration <= 0 {
+		return fmt.Errorf("invalid health timeouts %s, %s", c.Health.StallTimeout.Duration, c.Health.WatchTimeout.Duration)
+	}
+	if _, err := c.Logging.ZapLevel(); err != nil {
+		return err
+	}
+	if c.Endpoints.WebhookPort <= 0 || c.Endpoints.WebhookPort > 65535 {
+		return fmt.Errorf("invalid webhook port %d", c.Endpoints.WebhookPort)
+	}
+	return nil
+}
+
+// RouteOptions the options of the router
+func (c *Config) RouteOptions() route.Options {
+	return route.Options{
+		Protocol:          c.Route.Protocol,
+		Realm:             c.Route.Realm,
+		AdoptUnmarked:     c.Route.AdoptUnmarked,
+		Table:             c.Route.Table,
+		RulePriority:      c.Route.RulePriority,
+		IPIP:              c.Tunnel.IPIP,
+		IPIPMTU:           c.Tunnel.IPIPMTU,
+		VXLAN:             c.Tunnel.VXLAN,
+		VXLANMTU:          c.Tunnel.VXLANMTU,
+		VXLANVNI:          c.Tunnel.VXLANVNI,
+		VXLANPort:         c.Tunnel.VXLANPort,
+		DriftDebounce:     c.Intervals.DriftDebounce.Duration,
+		DryRun:            c.Route.DryRun,
+		StateFile:         c.StateFile,
+		MaxDeleteFraction: c.DeleteBreaker.MaxFraction,
+		MaxDeleteCount:    c.DeleteBreaker.MaxCount,
+	}
+}
+
+// Settings the reloadable settings of the reconcilers
+func (c *Config) Settings() (controllers.Settings, error) {
+	var settings controllers.Settings
+	sources, err := util.ParseAddressSources(strings.Join(c.NodeAddress.Sources, ","))
+	if err != nil {
+		return settings, err
+	}
+	settings.AddressPolicy = util.NodeAddressPolicy{Sources: sources, LocalSubnet: c.NodeAddress.LocalSubnet}
+	settings.EnforceNodeSelector = c.EnforcePoolNodeSelector
+	f := c.Filters
+	settings.PoolFilter, err = controllers.NewPoolFilter(f.IncludePools, f.ExcludePools, f.PoolSelector, f.IncludePoolCIDRs, f.ExcludePoolCIDRs)
+	if err != nil {
+		return settings, err
+	}
+	settings.NodeFilter, err = controllers.NewNodeFilter(f.NodeSelector, f.IncludeNodes, f.ExcludeNodes)
+	return settings, err
+}
+
+// debugVerbosity the most verbose V level of the logs, printed at the debug level
+const debugVerbosity = 4
+
+// ZapLevel the parsed log level, debug also enables the V levels up to debugVerbosity
+func (l Logging) ZapLevel() (zapcore.Level, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", l.Level)
+	}
+	if level == zapcore.DebugLevel {
+		level = -debugVerbosity
+	}
+	return level, nil
+}
+
+// KlogVerbosity the verbosity of the klog V logs of the route package, only printed at the debug level
+func (l Logging) KlogVerbosity() int {
+	if level, _ := l.ZapLevel(); level < zapcore.InfoLevel {
+		return debugVerbosity
+	}
+	return 0
+}
+
+// RestartRequired the sections changed from c to next which are only applied on restart
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	if !reflect.DeepEqual(c.Route, next.Route) {
+		changed = append(changed, "route")
+	}
+	if !reflect.DeepEqual(c.Tunnel, next.Tunnel) {
+		changed = append(changed, "tunnel")
+	}
+	if c.BorrowedIPRoutes != next.BorrowedIPRoutes {
+		changed = append(changed, "borrowedIPRoutes")
+	}
+	if c.ShutdownPolicy != next.ShutdownPolicy || c.StateFile != next.StateFile {
+		changed = append(changed, "shutdownPolicy/stateFile")
+	}
+	if c.DeleteBreaker != next.DeleteBreaker {
+		changed = append(changed, "deleteBreaker")
+	}
+	if c.Intervals.Resync != next.Intervals.Resync || c.Intervals.DriftDebounce != next.Intervals.DriftDebounce {
+		changed = append(changed, "intervals.resync/driftDebounce")
+	}
+	if c.Logging.Development != next.Logging.Development {
+		changed = append(changed, "logging.development")
+	}
+	if !reflect.DeepEqual(c.Endpoints, next.Endpoints) {
+		changed = append(changed, "endpoints")
+	}
+	if c.Health != next.Health {
+		changed = append(changed, "health")
+	}
+	return changed
+}
+
+// stringList a comma separated list flag
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// testLoad write the file (if any) and load it with the command line args, like main does
+func testLoad(t *testing.T, file string, args ...string) (*Config, error) {
+	t.Helper()
+	var path string
+	if file != "" {
+		path = filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmdline := flag.NewFlagSet("test", flag.ContinueOnError)
+	Default().BindFlags(cmdline)
+	if err := cmdline.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path, cmdline)
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		// want applied to the defaults
+		want func(c *Config)
+	}{
+		{name: "defaults", want: func(c *Config) {}},
+		{
+			name: "yaml file",
+			file: `
+route:
+  table: 100
+  protocol: 90
+intervals:
+  sync: 30s
+filters:
+  includePools: [a, b]
+nodeAddress:
+  sources: [InternalIP]
+shutdownPolicy: keep
+`,
+			want: func(c *Config) {
+				c.Route.Table = 100
+				c.Route.Protocol = 90
+				c.Intervals.Sync.Duration = 30 * time.Second
+				c.Filters.IncludePools = []string{"a", "b"}
+				c.NodeAddress.Sources = []string{"InternalIP"}
+				c.ShutdownPolicy = ShutdownKeep
+			},
+		},
+		{
+			name: "json file",
+			file: `{"tunnel": {"vxlan": true, "vxlanVNI": 42}, "logging": {"level": "debug"}}`,
+			want: func(c *Config) {
+				c.Tunnel.VXLAN = true
+				c.Tunnel.VXLANVNI = 42
+				c.Logging.Level = "debug"
+			},
+		},
+		{
+			name: "flags over the file",
+			file: `
+route:
+  table: 100
+  realm: 7
+filters:
+  includePools: [a, b]
+`,
+			args: []string{"--route-table=200", "--include-pools=c", "--sync-interval=10s", "--ipip"},
+			want: func(c *Config) {
+				c.Route.Table = 200
+				c.Route.Realm = 7
+				c.Filters.IncludePools = []string{"c"}
+				c.Intervals.Sync.Duration = 10 * time.Second
+				c.Tunnel.IPIP = true
+			},
+		},
+		{
+			name: "flag set to its default overrides the file",
+			file: "route:\n  table: 100\n",
+			args: []string{"--route-table=0"},
+			want: func(c *Config) {},
+		},
+	}
+	for _, tt := range tests {
+		got, err := testLoad(t, tt.file, tt.args...)
+		if err != nil {
+			t.Errorf("%s: Load err: %v", tt.name, err)
+			continue
+		}
+		want := Default()
+		tt.want(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Load = %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		// want a part of the error
+		want string
+	}{
+		{"unknown key", "route:\n  tabel: 100\n", nil, "parse config file"},
+		{"wrong type", "route:\n  table: main\n", nil, "parse config file"},
+		{"protocol", "route:\n  protocol: 4\n", nil, "invalid route protocol"},
+		{"local table", "", []string{"--route-table=255"}, "invalid route table"},
+		{"delete fraction", "deleteBreaker:\n  maxFraction: 1.5\n", nil, "invalid max delete fraction"},
+		{"vxlan vni", "tunnel:\n  vxlan: true\n  vxlanVNI: 0\n", nil, "invalid vxlan vni"},
+		{"address source", "nodeAddress:\n  sources: [PublicIP]\n", nil, "invalid node address source"},
+		{"pool selector", "", []string{"--pool-selector=a in (b"}, "invalid pool selector"},
+		{"node regexp", "filters:\n  includeNodes: '('\n", nil, "invalid node name regexp"},
+		{"pool cidr", "", []string{"--exclude-pool-cidrs=10.0.0.0/33"}, "invalid cidr"},
+		{"shutdown policy", "", []string{"--shutdown-policy=drop"}, "invalid shutdown policy"},
+		{"sync interval", "intervals:\n  sync: 0s\n", nil, "invalid sync interval"},
+		{"resync period", "", []string{"--resync-period=-1s"}, "invalid resync period"},
+		{"health timeout", "health:\n  stallTimeout: 0s\n", nil, "invalid health timeouts"},
+		{"log level", "", []string{"--log-level=loud"}, "invalid log level"},
+		{"webhook port", "endpoints:\n  webhookPort: 70000\n", nil, "invalid webhook port"},
+	}
+	for _, tt := range tests {
+		_, err := testLoad(t, tt.file, tt.args...)
+		if err == nil {
+			t.Errorf("%s: Load succeeded, want an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load err: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+		t.Errorf("Load of a missing file succeeded")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"nothing", func(c *Config) {}, nil},
+		{"filters", func(c *Config) { c.Filters.ExcludePools = []string{"a"} }, nil},
+		{"node address", func(c *Config) { c.NodeAddress.LocalSubnet = true }, nil},
+		{"pool node selector", func(c *Config) { c.EnforcePoolNodeSelector = true }, nil},
+		{"sync interval", func(c *Config) { c.Intervals.Sync.Duration = time.Hour }, nil},
+		{"log level", func(c *Config) { c.Logging.Level = "debug" }, nil},
+		{"route", func(c *Config) { c.Route.Table = 100 }, []string{"route"}},
+		{"dry run", func(c *Config) { c.Route.DryRun = true }, []string{"route"}},
+		{"tunnel", func(c *Config) { c.Tunnel.IPIP = true }, []string{"tunnel"}},
+		{"borrowed", func(c *Config) { c.BorrowedIPRoutes = true }, []string{"borrowedIPRoutes"}},
+		{"state file", func(c *Config) { c.StateFile = "/var/lib/state" }, []string{"shutdownPolicy/stateFile"}},
+		{"breaker", func(c *Config) { c.DeleteBreaker.MaxCount = 10 }, []string{"deleteBreaker"}},
+		{"drift debounce", func(c *Config) { c.Intervals.DriftDebounce.Duration = time.Second }, []string{"intervals.resync/driftDebounce"}},
+		{"log development", func(c *Config) { c.Logging.Development = false }, []string{"logging.development"}},
+		{"endpoints", func(c *Config) { c.Endpoints.Metrics = ":9100" }, []string{"endpoints"}},
+		{"health", func(c *Config) { c.Health.WatchTimeout.Duration = time.Minute }, []string{"health"}},
+		{"several", func(c *Config) {
+			c.Route.Realm = 1
+			c.Health.StallTimeout.Duration = time.Minute
+			c.Filters.PoolSelector = "a=b"
+		}, []string{"route", "health"}},
+	}
+	for _, tt := range tests {
+		next := Default()
+		tt.change(next)
+		if got := Default().RestartRequired(next); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: RestartRequired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		level     string
+		zap       zapcore.Level
+		verbosity int
+	}{
+		{"debug", -debugVerbosity, debugVerbosity},
+		{"info", zapcore.InfoLevel, 0},
+		{"warn", zapcore.WarnLevel, 0},
+		{"error", zapcore.ErrorLevel, 0},
+	}
+	for _, tt := range tests {
+		l := Logging{Level: tt.level}
+		level, err := l.ZapLevel()
+		if err != nil || level != tt.zap {
+			t.Errorf("ZapLevel of %s = %v, %v, want %v", tt.level, level, err, tt.zap)
+		}
+		if got := l.KlogVerbosity(); got != tt.verbosity {
+			t.Errorf("KlogVerbosity of %s = %d, want %d", tt.level, got, tt.verbosity)
+		}
+	}
+}
@@ -4,75 +4,116 @@ import (
 	"context"
 	"encoding/json"
 	"net"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/yzxiu/calico-route-sync/pkg/calico"
 	"github.com/yzxiu/calico-route-sync/pkg/route"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
 	"github.com/yzxiu/calico-route-sync/pkg/util"
 	v1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/tools/cache"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
+// blockAffinityDeleted the state of an affinity marked deleted
+const blockAffinityDeleted = "deleted"
+
+// blockAffinityCIDRField index the BlockAffinities by their block cidr, a moved block has one per node
+const blockAffinityCIDRField = "spec.cidr"
+
+func indexBlockAffinityCIDR(obj client.Object) []string {
+	ba, ok := obj.(*calico.BlockAffinity)
+	if !ok || ba.Spec.CIDR == "" {
+		return nil
+	}
+	return []string{ba.Spec.CIDR}
+}
+
 // BlockAffinityReconciler reconciles a BlockAffinity object
 type BlockAffinityReconciler struct {
 	client.Client
 	Log          logr.Logger
 	Scheme       *runtime.Scheme
 	NodeLister   cache.GenericLister
+	NodeInformer cache.SharedIndexInformer
 	IpPoolLister cache.GenericLister
 	Router       *route.Router
+	Settings     *SettingsStore
+	// PoolEvents the BlockAffinities to reconcile because their IPPool changed
+	PoolEvents <-chan event.GenericEvent
+
+	mu sync.Mutex
+	// blocks the last seen cidr of the BlockAffinities
+	blocks map[k8stypes.NamespacedName]string
+	// deferring the reconciles are skipped until the first full sync lists the BlockAffinities,
+	// deferred the skipped ones, reconciled again only when that sync fails
+	deferring bool
+	deferred  map[k8stypes.NamespacedName]bool
+	// retries the deferred BlockAffinities to reconcile again
+	retries chan event.GenericEvent
 }
 
 func (r *BlockAffinityReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	log := r.Log.WithValues("BlockAffinity", req.NamespacedName)
+	if r.deferReconcile(req.NamespacedName) {
+		log.Info("Reconcile deferred to the first full sync")
+		return ctrl.Result{}, nil
+	}
 
 	blockAffinity := &calico.BlockAffinity{}
 	err := r.Get(ctx, req.NamespacedName, blockAffinity)
 
 	if err != nil {
-		r.Router.CheckRouters(r.getIpPoolsNets(), r.getBlockAffinityNets(ctx))
 		if apierrs.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			// BlockAffinities have no finalizer, the cidr of a deleted one is only known from its last reconcile
+			return ctrl.Result{}, r.forgetBlock(ctx, log, req.NamespacedName)
 		}
 		log.Error(err, "unable to fetch blockaffinity")
 		return ctrl.Result{}, err
 	}
 
-	log.Info("Reconciling BlockAffinity", "name", blockAffinity.Name)
+	log.Info("Reconciling BlockAffinity", "name", blockAffinity.Name, "state", blockAffinityState(blockAffinity))
+	r.rememberBlock(req.NamespacedName, blockAffinity.Spec.CIDR)
 
 	// delete
 	if !blockAffinity.ObjectMeta.DeletionTimestamp.IsZero() {
 		log.Info("Delete BlockAffinity", "name", blockAffinity.Name)
-		err = r.Router.DeleteRoute(blockAffinity)
+		err = r.deleteRoute(ctx, log, req.NamespacedName, blockAffinity.Spec.CIDR)
 		if err != nil {
-			r.Router.CheckRouters(r.getIpPoolsNets(), r.getBlockAffinityNets(ctx))
 			log.Error(err, "del route error")
 			return ctrl.Result{}, err
 		}
 		return ctrl.Result{}, nil
 	}
 
-	node, err := r.getNode(blockAffinity.Spec.Node)
+	desired, reason, err := r.desiredRoute(blockAffinity, enabledPools(r.IpPoolLister))
 	if err != nil {
-		r.Router.CheckRouters(r.getIpPoolsNets(), r.getBlockAffinityNets(ctx))
-		if apierrs.IsNotFound(err) {
-			return ctrl.Result{}, nil
-		}
-		log.Error(err, "unable to get node")
+		log.Error(err, "unable to compute route")
 		return ctrl.Result{}, err
 	}
-	nodeIP := util.NodeInternalIP(node)
-	log.Info("Reconciling BlockAffinity", "node name", node.Name, "node ip", nodeIP)
+	if desired == nil {
+		log.Info("BlockAffinity must not be routed, delete route", "reason", reason, "cidr", blockAffinity.Spec.CIDR)
+		return ctrl.Result{}, r.deleteRoute(ctx, log, req.NamespacedName, blockAffinity.Spec.CIDR)
+	}
+	if reason != "" {
+		log.Info("BlockAffinity is routed but flagged", "reason", reason, "node name", blockAffinity.Spec.Node)
+	}
+	log.Info("Reconciling BlockAffinity", "node name", blockAffinity.Spec.Node, "node ip", desired.GwIP)
 
 	// update route
-	err = r.Router.UpdateRoute(blockAffinity, nodeIP)
+	err = r.Router.UpdateRoute(desired)
 	if err != nil {
 		log.Error(err, "update route error")
 		return ctrl.Result{}, err
@@ -81,63 +122,270 @@ func (r *BlockAffinityReconciler) Reconcile(ctx context.Context, req reconcile.R
 	return ctrl.Result{}, nil
 }
 
-func (r *BlockAffinityReconciler) getNode(nodeName string) (*v1.Node, error) {
-	uNode, err := r.NodeLister.Get(nodeName)
+// desiredRoute the route of the block, nil with the reason when the block must not be routed.
+// A route with a reason is routed but flagged. An error is only returned when the decision can not be made
+func (r *BlockAffinityReconciler) desiredRoute(blockAffinity *calico.BlockAffinity, pools []ipPool) (*types.Route, string, error) {
+	// only a confirmed affinity is backed by a block on the node, a deleted one is on its way out
+	if state := blockAffinityState(blockAffinity); state != calico.StateConfirmed {
+		return nil, "state " + state, nil
+	}
+	blockNet := util.ParseNet(blockAffinity.Spec.CIDR)
+	if blockNet == nil {
+		return nil, "invalid cidr", nil
+	}
+	// only the blocks of the enabled pools are routed, the pool may be deleted or disabled
+	pool := poolOf(pools, blockNet)
+	if pool == nil {
+		return nil, "not in any enabled IPPool", nil
+	}
+	node, err := r.getNode(blockAffinity.Spec.Node)
 	if err != nil {
-		return nil, err
+		if apierrs.IsNotFound(err) {
+			// the node is gone, its address can not be trusted anymore
+			return nil, "node not found", nil
+		}
+		return nil, "", err
 	}
-	bytes, err := runtime.Encode(unstructured.UnstructuredJSONScheme, uNode)
-	var tNode v1.Node
-	if err = json.Unmarshal(bytes, &tNode); err != nil {
-		return nil, err
+	settings := r.Settings.Load()
+	if !settings.NodeFilter.Matches(node) {
+		return nil, "node filtered out", nil
 	}
-	return &tNode, nil
+	// calico only affines blocks of a pool to the nodes it selects, a node relabeled afterwards keeps its blocks
+	var flag string
+	if pool.NodeSelector == nil {
+		flag = "invalid IPPool nodeSelector"
+	} else if !pool.NodeSelector.Matches(node.Labels) {
+		if settings.EnforceNodeSelector {
+			return nil, "node not selected by IPPool nodeSelector", nil
+		}
+		flag = "node not selected by IPPool nodeSelector"
+	}
+	route, reason := nodeRoute(node, nodeIP(settings.AddressPolicy, r.Router, node, blockNet), blockNet, pool)
+	if route == nil {
+		return nil, reason, nil
+	}
+	return route, flag, nil
 }
 
-func (r *BlockAffinityReconciler) getIpPoolsNets() []net.IPNet {
-	var tPools []net.IPNet
-	list, err := r.IpPoolLister.List(labels.Everything())
+// nodeIP the gateway address of the node for dst, selected by the policy
+func nodeIP(policy util.NodeAddressPolicy, router *route.Router, node *v1.Node, dst *net.IPNet) net.IP {
+	var localNetworks []types.LocalNetwork
+	if policy.LocalSubnet {
+		localNetworks = router.LocalNetworks()
+	}
+	// dual-stack: the gateway must be the node address of the same family as the block
+	return policy.NodeIP(node, util.IPFamily(dst.IP), localNetworks)
+}
+
+// nodeRoute the route of dst via the node, nil with the reason when the node can not be the gateway
+func nodeRoute(node *v1.Node, nodeIP net.IP, dst *net.IPNet, pool *ipPool) (*types.Route, string) {
+	if nodeIP == nil {
+		return nil, "node has no address of the block family"
+	}
+	return &types.Route{
+		DstNet:    dst,
+		GwIP:      nodeIP,
+		IPIPMode:  pool.Spec.IPIPMode,
+		VXLANMode: pool.Spec.VXLANMode,
+		VTEP:      util.NodeVTEP(node, nodeIP),
+	}, ""
+}
+
+// blockAffinityState the state of the affinity, deleted when it is marked deleted
+func blockAffinityState(blockAffinity *calico.BlockAffinity) string {
+	if blockAffinity.Spec.Deleted == "true" {
+		return blockAffinityDeleted
+	}
+	if blockAffinity.Spec.State == "" {
+		return "unknown"
+	}
+	return blockAffinity.Spec.State
+}
+
+// deleteRoute del the route of the block cidr released by the BlockAffinity name. A block moved to
+// another node keeps the route via the node of its confirmed BlockAffinity. The routes outside the
+// enabled pools are out of scope, those of a deleted or disabled pool are removed by the IPPoolReconciler
+func (r *BlockAffinityReconciler) deleteRoute(ctx context.Context, log logr.Logger, name k8stypes.NamespacedName, cidr string) error {
+	blockNet := util.ParseNet(cidr)
+	if blockNet == nil || !util.ContainedInAny(r.getIpPoolsNets(), blockNet) {
+		return nil
+	}
+	owner, err := r.ownerRoute(ctx, name, cidr)
 	if err != nil {
-		return tPools
+		return err
+	}
+	if owner != nil {
+		log.Info("block claimed by another BlockAffinity, keep its route", "cidr", cidr, "node ip", owner.GwIP)
+		return r.Router.UpdateRoute(owner)
+	}
+	return r.Router.DeleteRoute(blockNet)
+}
+
+// ownerRoute the route of the block via another BlockAffinity routed for the cidr, nil when there is none
+func (r *BlockAffinityReconciler) ownerRoute(ctx context.Context, name k8stypes.NamespacedName, cidr string) (*types.Route, error) {
+	blockAffinityList := &calico.BlockAffinityList{}
+	if err := r.List(ctx, blockAffinityList, client.MatchingFields{blockAffinityCIDRField: cidr}); err != nil {
+		return nil, err
 	}
-	for _, pool := range list {
-		bytes, err := runtime.Encode(unstructured.UnstructuredJSONScheme, pool)
-		var tPool calico.IPPool
-		if err = json.Unmarshal(bytes, &tPool); err != nil {
+	pools := enabledPools(r.IpPoolLister)
+	for i := range blockAffinityList.Items {
+		ba := &blockAffinityList.Items[i]
+		if (ba.Name == name.Name && ba.Namespace == name.Namespace) || !ba.DeletionTimestamp.IsZero() {
 			continue
 		}
-		if !tPool.Spec.Disabled {
-			n := util.ParseNet(tPool.Spec.CIDR)
-			if n != nil {
-				tPools = append(tPools, *n)
+		// only a confirmed affinity is routed
+		route, _, err := r.desiredRoute(ba, pools)
+		if err != nil {
+			return nil, err
+		}
+		if route != nil {
+			return route, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *BlockAffinityReconciler) rememberBlock(name k8stypes.NamespacedName, cidr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blocks == nil {
+		r.blocks = map[k8stypes.NamespacedName]string{}
+	}
+	r.blocks[name] = cidr
+}
+
+// DeferToFullSync skip the reconciles until the first full sync lists the BlockAffinities, the startup
+// reconcile of each BlockAffinity is covered by the batched changes of that sync
+func (r *BlockAffinityReconciler) DeferToFullSync() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deferring = true
+	r.deferred = map[k8stypes.NamespacedName]bool{}
+}
+
+// deferReconcile whether the reconcile is skipped, it is recorded then
+func (r *BlockAffinityReconciler) deferReconcile(name k8stypes.NamespacedName) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deferring {
+		r.deferred[name] = true
+	}
+	return r.deferring
+}
+
+// stopDeferring reconcile again from now on, returns the skipped reconciles
+func (r *BlockAffinityReconciler) stopDeferring() map[k8stypes.NamespacedName]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deferred := r.deferred
+	r.deferring, r.deferred = false, nil
+	return deferred
+}
+
+// retry reconcile the skipped BlockAffinities, the full sync which should have covered them failed
+func (r *BlockAffinityReconciler) retry(ctx context.Context, deferred map[k8stypes.NamespacedName]bool) {
+	if len(deferred) == 0 {
+		return
+	}
+	r.Log.Info("first full sync failed, reconcile the deferred BlockAffinities", "count", len(deferred))
+	go func() {
+		for name := range deferred {
+			ba := &calico.BlockAffinity{}
+			ba.Name, ba.Namespace = name.Name, name.Namespace
+			select {
+			case r.retries <- event.GenericEvent{Object: ba}:
+			case <-ctx.Done():
+				return
 			}
 		}
+	}()
+}
+
+// forgetBlock del the route of a deleted BlockAffinity
+func (r *BlockAffinityReconciler) forgetBlock(ctx context.Context, log logr.Logger, name k8stypes.NamespacedName) error {
+	r.mu.Lock()
+	cidr, ok := r.blocks[name]
+	delete(r.blocks, name)
+	r.mu.Unlock()
+	if !ok {
+		return nil
 	}
-	return tPools
+	log.Info("BlockAffinity deleted, delete route", "cidr", cidr)
+	return r.deleteRoute(ctx, log, name, cidr)
 }
 
-func (r *BlockAffinityReconciler) getBlockAffinityNets(ctx context.Context) []net.IPNet {
-	var bas []net.IPNet
-	blockAffinityList := &calico.BlockAffinityList{}
-	err := r.List(ctx, blockAffinityList)
+func (r *BlockAffinityReconciler) getNode(nodeName string) (*v1.Node, error) {
+	return getNode(r.NodeLister, nodeName)
+}
+
+func getNode(lister cache.GenericLister, nodeName string) (*v1.Node, error) {
+	uNode, err := lister.Get(nodeName)
 	if err != nil {
-		return bas
+		return nil, err
 	}
-	for _, ba := range blockAffinityList.Items {
-		n := util.ParseNet(ba.Spec.CIDR)
-		if n != nil {
-			bas = append(bas, *n)
-		}
+	bytes, err := runtime.Encode(unstructured.UnstructuredJSONScheme, uNode)
+	var tNode v1.Node
+	if err = json.Unmarshal(bytes, &tNode); err != nil {
+		return nil, err
 	}
-	return bas
+	return &tNode, nil
+}
+
+func (r *BlockAffinityReconciler) getIpPoolsNets() []net.IPNet {
+	return enabledPoolNets(r.IpPoolLister)
+}
+
+func enabledPoolNets(lister cache.GenericLister) []net.IPNet {
+	return poolNets(enabledPools(lister))
 }
 
 func (r *BlockAffinityReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &calico.BlockAffinity{}, blockAffinityNodeField, indexBlockAffinityNode)
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &calico.BlockAffinity{}, blockAffinityCIDRField, indexBlockAffinityCIDR)
+	if err != nil {
+		return err
+	}
+	r.retries = make(chan event.GenericEvent)
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&calico.BlockAffinity{}).
+		Watches(&source.Informer{Informer: r.NodeInformer},
+			handler.EnqueueRequestsFromMapFunc(r.mapNodeToBlockAffinities),
+			builder.WithPredicates(nodeRoutingChanged)).
+		Watches(&source.Channel{Source: r.PoolEvents}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Channel{Source: r.retries}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
 
+// ApplySettings replace the settings, the routes of the pools leaving the scope are removed.
+// The other routes are re-reconciled by the next full sync
+func (r *BlockAffinityReconciler) ApplySettings(settings Settings) error {
+	before := r.getIpPoolsNets()
+	r.Settings.Store(settings)
+	after := r.getIpPoolsNets()
+	var errs []error
+	for i := range before {
+		if util.ContainedInAny(after, &before[i]) {
+			continue
+		}
+		r.Log.Info("IPPool filtered out, delete its routes", "cidr", before[i].String())
+		if err := r.Router.DeletePoolRoutes(&before[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// AdoptCalicoRoutes keep the routes installed by a previous run as the desired routes, until the first
+// full sync reconciles them against the cluster state
+func (r *BlockAffinityReconciler) AdoptCalicoRoutes() error {
+	adopted, err := r.Router.AdoptRoutes(r.getIpPoolsNets())
+	r.Log.Info("adopted the routes of the previous run", "routes", adopted)
+	return err
+}
+
 func (r *BlockAffinityReconciler) CleanCalicoRoutes() {
 	r.Router.CleanRoutes(r.getIpPoolsNets())
 }
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PoolFilter which IPPools this host receives the routes of, the zero value selects every pool.
+// A filtered out pool is out of scope: its routes are not installed. The routes of a pool leaving the
+// filter on reload are deleted like those of a deleted pool, a pool filtered out from the start is never touched
+type PoolFilter struct {
+	// Include the names of the selected pools, empty means all
+	Include []string
+	Exclude []string
+	// Selector label selector of the selected pools, nil means all
+	Selector labels.Selector
+	// IncludeCIDRs a pool is selected when its cidr is inside one of them, empty means all
+	IncludeCIDRs []net.IPNet
+	ExcludeCIDRs []net.IPNet
+}
+
+// Matches whether the pool with the name, labels and cidr is selected
+func (f PoolFilter) Matches(name string, poolLabels map[string]string, cidr *net.IPNet) bool {
+	if len(f.Include) > 0 && !containsString(f.Include, name) {
+		return false
+	}
+	if containsString(f.Exclude, name) {
+		return false
+	}
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(poolLabels)) {
+		return false
+	}
+	if cidr == nil {
+		return len(f.IncludeCIDRs) == 0
+	}
+	if len(f.IncludeCIDRs) > 0 && !util.ContainedInAny(f.IncludeCIDRs, cidr) {
+		return false
+	}
+	return !util.ContainedInAny(f.ExcludeCIDRs, cidr)
+}
+
+// NodeFilter which nodes this host routes the blocks of, the zero value selects every node
+type NodeFilter struct {
+	// Selector label selector of the selected nodes, nil means all
+	Selector labels.Selector
+	// Include regexp matching the names of the selected nodes, nil means all
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// Matches whether the node is selected
+func (f NodeFilter) Matches(node *v1.Node) bool {
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	if f.Include != nil && !f.Include.MatchString(node.Name) {
+		return false
+	}
+	return f.Exclude == nil || !f.Exclude.MatchString(node.Name)
+}
+
+// FilterPools a lister only listing the pools selected by the current pool filter, the others are not found
+func FilterPools(lister cache.GenericLister, settings *SettingsStore) cache.GenericLister {
+	return &poolLister{GenericLister: lister, settings: settings}
+}
+
+type poolLister struct {
+	cache.GenericLister
+	settings *SettingsStore
+}
+
+func (l *poolLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	list, err := l.GenericLister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	var selected []runtime.Object
+	for _, obj := range list {
+		if l.selected(obj) {
+			selected = append(selected, obj)
+		}
+	}
+	return selected, nil
+}
+
+func (l *poolLister) Get(name string) (runtime.Object, error) {
+	obj, err := l.GenericLister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !l.selected(obj) {
+		return nil, apierrs.NewNotFound(schema.GroupResource{Group: calico.Group, Resource: "ippools"}, name)
+	}
+	return obj, nil
+}
+
+func (l *poolLister) selected(obj runtime.Object) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	cidr, _, _ := unstructured.NestedString(u.Object, "spec", "cidr")
+	return l.settings.Load().PoolFilter.Matches(u.GetName(), u.GetLabels(), util.ParseNet(cidr))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPoolFilter parse a PoolFilter, the empty values select everything
+func NewPoolFilter(include, exclude []string, selector string, includeCIDRs, excludeCIDRs []string) (PoolFilter, error) {
+	filter := PoolFilter{Include: include, Exclude: exclude}
+	var err error
+	if selector != "" {
+		if filter.Selector, err = labels.Parse(selector); err != nil {
+			return filter, fmt.Errorf("invalid pool selector %q: %v", selector, err)
+		}
+	}
+	if filter.IncludeCIDRs, err = parseCIDRs(includeCIDRs); err != nil {
+		return filter, err
+	}
+	if filter.ExcludeCIDRs, err = parseCIDRs(excludeCIDRs); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// NewNodeFilter parse a NodeFilter, the empty values select everything
+func NewNodeFilter(selector, include, exclude string) (NodeFilter, error) {
+	var filter NodeFilter
+	var err error
+	if selector != "" {
+		if filter.Selector, err = labels.Parse(selector); err != nil {
+			return filter, fmt.Errorf("invalid node selector %q: %v", selector, err)
+		}
+	}
+	if include != "" {
+		if filter.Include, err = regexp.Compile(include); err != nil {
+			return filter, fmt.Errorf("invalid node name regexp %q: %v", include, err)
+		}
+	}
+	if exclude != "" {
+		if filter.Exclude, err = regexp.Compile(exclude); err != nil {
+			return filter, fmt.Errorf("invalid node name regexp %q: %v", exclude, err)
+		}
+	}
+	return filter, nil
+}
+
+func parseCIDRs(cidrs []string) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	for _, cidr := range cidrs {
+		n := util.ParseNet(cidr)
+		if n == nil {
+			return nil, fmt.Errorf("invalid cidr %q", cidr)
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
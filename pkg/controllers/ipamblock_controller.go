@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/route"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// IPAMBlockReconciler reconciles the host routes of the addresses borrowed from an IPAMBlock:
+// an address allocated to another node than the one the block is affine to is not reachable
+// through the block route, it gets a /32 (/128) route via the node hosting it
+type IPAMBlockReconciler struct {
+	client.Client
+	Log            logr.Logger
+	NodeLister     cache.GenericLister
+	NodeInformer   cache.SharedIndexInformer
+	IpPoolLister   cache.GenericLister
+	IpPoolInformer cache.SharedIndexInformer
+	Router         *route.Router
+	Settings       *SettingsStore
+
+	mu sync.Mutex
+	// blocks the last seen cidr of the IPAMBlocks
+	blocks map[string]*net.IPNet
+}
+
+func (r *IPAMBlockReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log := r.Log.WithValues("IPAMBlock", req.Name)
+
+	block := &calico.IPAMBlock{}
+	err := r.Get(ctx, req.NamespacedName, block)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, r.forgetBlock(log, req.Name)
+		}
+		log.Error(err, "unable to fetch ipamblock")
+		return ctrl.Result{}, err
+	}
+
+	blockNet := util.ParseNet(block.Spec.CIDR)
+	if blockNet == nil {
+		log.Info("invalid IPAMBlock cidr", "cidr", block.Spec.CIDR)
+		return ctrl.Result{}, nil
+	}
+	r.rememberBlock(req.Name, blockNet)
+
+	if block.Spec.Deleted || !block.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.forgetBlock(log, req.Name)
+	}
+
+	pools := enabledPools(r.IpPoolLister)
+	if poolOf(pools, blockNet) == nil {
+		// out of scope, the routes of a deleted or disabled pool are removed by the IPPoolReconciler
+		return ctrl.Result{}, nil
+	}
+	routes, err := r.borrowedRoutes(block, pools, nil)
+	if err != nil {
+		log.Error(err, "unable to compute borrowed routes")
+		return ctrl.Result{}, err
+	}
+	if len(routes) > 0 {
+		log.Info("Reconciling IPAMBlock", "cidr", blockNet, "borrowed", len(routes))
+	}
+	if err = r.Router.SyncHostRoutes(blockNet, routes); err != nil {
+		log.Error(err, "sync borrowed routes error")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// borrowedRoutes the host routes of the addresses of the block allocated to other nodes than the affine one,
+// counted per node into perNode if not nil
+func (r *IPAMBlockReconciler) borrowedRoutes(block *calico.IPAMBlock, pools []ipPool, perNode map[string]int) ([]*types.Route, error) {
+	blockNet := util.ParseNet(block.Spec.CIDR)
+	if blockNet == nil {
+		return nil, nil
+	}
+	pool := poolOf(pools, blockNet)
+	if pool == nil {
+		return nil, nil
+	}
+	settings := r.Settings.Load()
+	affinity := affineNode(block)
+	nodes := map[string]*v1.Node{}
+	var routes []*types.Route
+	for ordinal, attrIndex := range block.Spec.Allocations {
+		nodeName := allocationNode(block, attrIndex)
+		if nodeName == "" || nodeName == affinity {
+			continue
+		}
+		ip := util.NthIP(blockNet, ordinal)
+		if ip == nil {
+			continue
+		}
+		node, ok := nodes[nodeName]
+		if !ok {
+			var err error
+			node, err = getNode(r.NodeLister, nodeName)
+			if err != nil && !apierrs.IsNotFound(err) {
+				return nil, err
+			}
+			nodes[nodeName] = node
+		}
+		if node == nil || !settings.NodeFilter.Matches(node) {
+			continue
+		}
+		dst := util.HostNet(ip)
+		if route, _ := nodeRoute(node, nodeIP(settings.AddressPolicy, r.Router, node, dst), dst, pool); route != nil {
+			routes = append(routes, route)
+			if perNode != nil {
+				perNode[nodeName]++
+			}
+		}
+	}
+	return routes, nil
+}
+
+// affineNode the node the block is affine to, empty if none
+func affineNode(block *calico.IPAMBlock) string {
+	if block.Spec.Affinity == nil || !strings.HasPrefix(*block.Spec.Affinity, calico.IPAMBlockAffinityPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(*block.Spec.Affinity, calico.IPAMBlockAffinityPrefix)
+}
+
+// allocationNode the node an allocation is made for, empty if the address is free or has no node
+func allocationNode(block *calico.IPAMBlock, attrIndex *int) string {
+	if attrIndex == nil || *attrIndex < 0 || *attrIndex >= len(block.Spec.Attributes) {
+		return ""
+	}
+	return block.Spec.Attributes[*attrIndex].AttrSecondary[calico.IPAMBlockAttributeNode]
+}
+
+func (r *IPAMBlockReconciler) rememberBlock(name string, blockNet *net.IPNet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blocks == nil {
+		r.blocks = map[string]*net.IPNet{}
+	}
+	r.blocks[name] = blockNet
+}
+
+// forgetBlock del the borrowed routes of a deleted IPAMBlock
+func (r *IPAMBlockReconciler) forgetBlock(log logr.Logger, name string) error {
+	r.mu.Lock()
+	blockNet, ok := r.blocks[name]
+	delete(r.blocks, name)
+	r.mu.Unlock()
+	if !ok || !util.ContainedInAny(enabledPoolNets(r.IpPoolLister), blockNet) {
+		return nil
+	}
+	log.Info("IPAMBlock deleted, delete its borrowed routes", "cidr", blockNet)
+	return r.Router.SyncHostRoutes(blockNet, nil)
+}
+
+// mapPoolToIPAMBlocks enqueue the IPAMBlocks of the pool
+func (r *IPAMBlockReconciler) mapPoolToIPAMBlocks(obj client.Object) []reconcile.Request {
+	pool, err := toIPPool(obj)
+	if err != nil {
+		return nil
+	}
+	poolNet := util.ParseNet(pool.Spec.CIDR)
+	if poolNet == nil {
+		return nil
+	}
+	blockList := &calico.IPAMBlockList{}
+	if err = r.List(context.TODO(), blockList); err != nil {
+		r.Log.Error(err, "unable to list ipamblocks of pool", "pool", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, block := range blockList.Items {
+		blockNet := util.ParseNet(block.Spec.CIDR)
+		if blockNet != nil && util.ContainsCIDR(poolNet, blockNet) {
+			requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{Name: block.Name}})
+		}
+	}
+	return requests
+}
+
+func (r *IPAMBlockReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &calico.IPAMBlock{}, ipamBlockNodeField, indexIPAMBlockNodes)
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&calico.IPAMBlock{}).
+		Watches(&source.Informer{Informer: r.NodeInformer},
+			handler.EnqueueRequestsFromMapFunc(r.mapNodeToIPAMBlocks),
+			builder.WithPredicates(nodeRoutingChanged)).
+		Watches(&source.Informer{Informer: r.IpPoolInformer}, handler.EnqueueRequestsFromMapFunc(r.mapPoolToIPAMBlocks)).
+		Complete(r)
+}
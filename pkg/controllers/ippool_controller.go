@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/route"
+	"github.com/yzxiu/calico-route-sync/pkg/selector"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// IPPoolReconciler reconciles the routes of an IPPool: the routes of the blocks of a
+// created or enabled pool are (re)added, the routes of a deleted or disabled pool are removed
+type IPPoolReconciler struct {
+	client.Client
+	Log            logr.Logger
+	IpPoolLister   cache.GenericLister
+	IpPoolInformer cache.SharedIndexInformer
+	Router         *route.Router
+	// BlockEvents the BlockAffinities to be reconciled by the BlockAffinityReconciler
+	BlockEvents chan<- event.GenericEvent
+
+	mu sync.Mutex
+	// pools the last seen cidr of the enabled pools, a deleted pool can not be read anymore
+	pools map[string]*net.IPNet
+}
+
+func (r *IPPoolReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log := r.Log.WithValues("IPPool", req.Name)
+
+	// a dedicated route table is only looked up through the ip rules of the pools
+	if err := r.Router.EnsureRules(enabledPoolNets(r.IpPoolLister)); err != nil {
+		log.Error(err, "ensure rules error")
+	}
+
+	obj, err := r.IpPoolLister.Get(req.Name)
+	if err != nil && !apierrs.IsNotFound(err) {
+		log.Error(err, "unable to get ippool")
+		return ctrl.Result{}, err
+	}
+	var pool *calico.IPPool
+	if err == nil {
+		if pool, err = toIPPool(obj); err != nil {
+			log.Error(err, "unable to decode ippool")
+			return ctrl.Result{}, nil
+		}
+	}
+
+	if pool == nil || pool.Spec.Disabled {
+		return ctrl.Result{}, r.removePool(log, req.Name)
+	}
+
+	poolNet := util.ParseNet(pool.Spec.CIDR)
+	if poolNet == nil {
+		log.Info("invalid IPPool cidr", "cidr", pool.Spec.CIDR)
+		return ctrl.Result{}, nil
+	}
+	r.mu.Lock()
+	if r.pools == nil {
+		r.pools = map[string]*net.IPNet{}
+	}
+	previous := r.pools[req.Name]
+	r.pools[req.Name] = poolNet
+	r.mu.Unlock()
+	// the cidr of a pool can not be changed in calico, just in case
+	if previous != nil && previous.String() != poolNet.String() {
+		r.deletePoolNet(log, previous)
+	}
+
+	blockAffinityList := &calico.BlockAffinityList{}
+	if err = r.List(ctx, blockAffinityList); err != nil {
+		log.Error(err, "unable to list blockaffinities")
+		return ctrl.Result{}, err
+	}
+	var count int
+	for i := range blockAffinityList.Items {
+		ba := &blockAffinityList.Items[i]
+		blockNet := util.ParseNet(ba.Spec.CIDR)
+		if blockNet == nil || !util.ContainsCIDR(poolNet, blockNet) {
+			continue
+		}
+		select {
+		case r.BlockEvents <- event.GenericEvent{Object: ba}:
+			count++
+		case <-ctx.Done():
+			return ctrl.Result{}, ctx.Err()
+		}
+	}
+	log.Info("Reconciling IPPool", "cidr", poolNet, "blocks", count)
+	return ctrl.Result{}, nil
+}
+
+// removePool del the routes of a deleted or disabled pool
+func (r *IPPoolReconciler) removePool(log logr.Logger, name string) error {
+	r.mu.Lock()
+	poolNet := r.pools[name]
+	delete(r.pools, name)
+	r.mu.Unlock()
+	if poolNet == nil {
+		return nil
+	}
+	return r.deletePoolNet(log, poolNet)
+}
+
+func (r *IPPoolReconciler) deletePoolNet(log logr.Logger, poolNet *net.IPNet) error {
+	// overlapping pools are not allowed by calico, just in case
+	if util.ContainedInAny(enabledPoolNets(r.IpPoolLister), poolNet) {
+		return nil
+	}
+	log.Info("IPPool removed or disabled, delete its routes", "cidr", poolNet)
+	return r.Router.DeletePoolRoutes(poolNet)
+}
+
+func (r *IPPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("ippool").
+		Watches(&source.Informer{Informer: r.IpPoolInformer}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
+
+// ipPool an enabled pool with its parsed cidr and nodeSelector
+type ipPool struct {
+	calico.IPPool
+	Net *net.IPNet
+	// NodeSelector nil when the nodeSelector is invalid
+	NodeSelector selector.Selector
+}
+
+func enabledPools(lister cache.GenericLister) []ipPool {
+	var tPools []ipPool
+	list, err := lister.List(labels.Everything())
+	if err != nil {
+		return tPools
+	}
+	for _, pool := range list {
+		tPool, err := toIPPool(pool)
+		if err != nil {
+			continue
+		}
+		if !tPool.Spec.Disabled {
+			n := util.ParseNet(tPool.Spec.CIDR)
+			if n != nil {
+				nodeSelector, _ := selector.Parse(tPool.Spec.NodeSelector)
+				tPools = append(tPools, ipPool{IPPool: *tPool, Net: n, NodeSelector: nodeSelector})
+			}
+		}
+	}
+	return tPools
+}
+
+func poolNets(pools []ipPool) []net.IPNet {
+	nets := make([]net.IPNet, 0, len(pools))
+	for _, pool := range pools {
+		nets = append(nets, *pool.Net)
+	}
+	return nets
+}
+
+// poolOf the pool containing the block, nil if none
+func poolOf(pools []ipPool, block *net.IPNet) *ipPool {
+	for i := range pools {
+		if util.ContainsCIDR(pools[i].Net, block) {
+			return &pools[i]
+		}
+	}
+	return nil
+}
+
+func toIPPool(obj runtime.Object) (*calico.IPPool, error) {
+	bytes, err := runtime.Encode(unstructured.UnstructuredJSONScheme, obj)
+	if err != nil {
+		return nil, err
+	}
+	var tPool calico.IPPool
+	if err = json.Unmarshal(bytes, &tPool); err != nil {
+		return nil, err
+	}
+	return &tPool, nil
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// blockAffinityNodeField index the BlockAffinities by the node they are affine to
+const blockAffinityNodeField = "spec.node"
+
+func indexBlockAffinityNode(obj client.Object) []string {
+	ba, ok := obj.(*calico.BlockAffinity)
+	if !ok || ba.Spec.Node == "" {
+		return nil
+	}
+	return []string{ba.Spec.Node}
+}
+
+// ipamBlockNodeField index the IPAMBlocks by the nodes holding addresses borrowed from them
+const ipamBlockNodeField = "spec.borrowers"
+
+func indexIPAMBlockNodes(obj client.Object) []string {
+	block, ok := obj.(*calico.IPAMBlock)
+	if !ok {
+		return nil
+	}
+	affinity := affineNode(block)
+	var nodes []string
+	seen := map[string]bool{}
+	for _, attrIndex := range block.Spec.Allocations {
+		node := allocationNode(block, attrIndex)
+		if node == "" || node == affinity || seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// routingAnnotations the node annotations the routes of its blocks depend on
+var routingAnnotations = []string{
+	calico.AnnotationIPv4Address,
+	calico.AnnotationIPv6Address,
+	calico.AnnotationIPv4VXLANTunnelAddr,
+	calico.AnnotationVXLANTunnelMACAddr,
+}
+
+// nodeRoutingChanged only let through the node updates which can move the routes of its blocks:
+// its addresses, the calico annotations and the labels matched by the nodeSelector of the pools
+var nodeRoutingChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if !reflect.DeepEqual(nodeAddresses(e.ObjectOld), nodeAddresses(e.ObjectNew)) {
+			return true
+		}
+		if !reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) {
+			return true
+		}
+		oldAnnotations, newAnnotations := e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations()
+		for _, key := range routingAnnotations {
+			if oldAnnotations[key] != newAnnotations[key] {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+func nodeAddresses(obj client.Object) []interface{} {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	addresses, _, _ := unstructured.NestedSlice(u.Object, "status", "addresses")
+	return addresses
+}
+
+// mapNodeToBlockAffinities enqueue the BlockAffinities of the node
+func (r *BlockAffinityReconciler) mapNodeToBlockAffinities(obj client.Object) []reconcile.Request {
+	blockAffinityList := &calico.BlockAffinityList{}
+	err := r.List(context.TODO(), blockAffinityList, client.MatchingFields{blockAffinityNodeField: obj.GetName()})
+	if err != nil {
+		r.Log.Error(err, "unable to list blockaffinities of node", "node", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(blockAffinityList.Items))
+	for _, ba := range blockAffinityList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{
+			Namespace: ba.Namespace,
+			Name:      ba.Name,
+		}})
+	}
+	if len(requests) > 0 {
+		r.Log.Info("node changed, enqueue its blockaffinities", "node", obj.GetName(), "count", len(requests))
+	}
+	return requests
+}
+
+// mapNodeToIPAMBlocks enqueue the IPAMBlocks the node borrowed addresses from
+func (r *IPAMBlockReconciler) mapNodeToIPAMBlocks(obj client.Object) []reconcile.Request {
+	blockList := &calico.IPAMBlockList{}
+	err := r.List(context.TODO(), blockList, client.MatchingFields{ipamBlockNodeField: obj.GetName()})
+	if err != nil {
+		r.Log.Error(err, "unable to list ipamblocks of node", "node", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(blockList.Items))
+	for _, block := range blockList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{Name: block.Name}})
+	}
+	return requests
+}
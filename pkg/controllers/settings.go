@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"sync/atomic"
+
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+)
+
+// Settings the settings of the reconcilers which can be reloaded at runtime
+type Settings struct {
+	// AddressPolicy how the node address used as gateway is selected
+	AddressPolicy util.NodeAddressPolicy
+	// EnforceNodeSelector do not route the blocks of the nodes not selected by the nodeSelector of their IPPool
+	EnforceNodeSelector bool
+	// PoolFilter which pools are in scope
+	PoolFilter PoolFilter
+	// NodeFilter which nodes the blocks are routed of
+	NodeFilter NodeFilter
+}
+
+// SettingsStore the current Settings, replaced as a whole on reload
+type SettingsStore struct {
+	current atomic.Pointer[Settings]
+}
+
+func NewSettingsStore(settings Settings) *SettingsStore {
+	s := &SettingsStore{}
+	s.Store(settings)
+	return s
+}
+
+// Load the current settings, must not be modified
+func (s *SettingsStore) Load() *Settings {
+	return s.current.Load()
+}
+
+func (s *SettingsStore) Store(settings Settings) {
+	s.current.Store(&settings)
+}
@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"k8s.io/apimachinery/pkg/labels"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// Syncer periodically computes the complete desired route set
+// (all BlockAffinities x node ips x enabled pools) and applies the diff as batches of netlink messages
+type Syncer struct {
+	Reconciler *BlockAffinityReconciler
+	// Borrowed optional, adds the host routes of the addresses borrowed from the IPAMBlocks
+	Borrowed *IPAMBlockReconciler
+	// AllPools optional, the IPPools whatever the filters, the routes carrying our marker outside all of them are deleted
+	AllPools toolscache.GenericLister
+	// Cache the manager cache backing Reconciler's client, waited on before the first sync
+	Cache    cache.Cache
+	Interval time.Duration
+	Log      logr.Logger
+	// Watches optional, the route deletes stay frozen while a watch is broken
+	Watches *WatchMonitor
+
+	mu     sync.Mutex
+	resync chan time.Duration
+	// started, interval and finished of the sync loop, watched by the health checks
+	started  time.Time
+	interval time.Duration
+	finished time.Time
+	synced   bool
+}
+
+// Ready fail until the caches are synced and the first full sync succeeded
+func (s *Syncer) Ready(_ *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.synced {
+		return fmt.Errorf("first full sync not done")
+	}
+	return nil
+}
+
+// Alive fail when no full sync finished for longer than the interval and the timeout,
+// e.g. the caches never synced or a sync hangs
+func (s *Syncer) Alive(timeout time.Duration) func(*http.Request) error {
+	return func(_ *http.Request) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		last := s.finished
+		if last.IsZero() {
+			last = s.started
+		}
+		if last.IsZero() {
+			// not started yet
+			return nil
+		}
+		if stalled := time.Since(last); stalled > s.interval+timeout {
+			return fmt.Errorf("no full sync finished for %s", stalled.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// finish record the end of a full sync attempt
+func (s *Syncer) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = time.Now()
+	if err == nil {
+		s.synced = true
+	}
+}
+
+// Resync run a full sync now and continue with the interval, e.g. after the settings were reloaded
+func (s *Syncer) Resync(interval time.Duration) {
+	select {
+	case s.resyncCh() <- interval:
+	default:
+		// a resync is already pending
+	}
+}
+
+func (s *Syncer) resyncCh() chan time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resync == nil {
+		s.resync = make(chan time.Duration, 1)
+	}
+	return s.resync
+}
+
+// Start implements manager.Runnable
+func (s *Syncer) Start(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("invalid sync interval %s", s.Interval)
+	}
+	s.mu.Lock()
+	s.started, s.interval = time.Now(), s.Interval
+	s.mu.Unlock()
+	if !s.Cache.WaitForCacheSync(ctx) {
+		return fmt.Errorf("wait for cache sync failed")
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := s.SyncAll(ctx)
+		s.finish(err)
+		metrics.FullSyncDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.FullSyncs.WithLabelValues(metrics.ResultError).Inc()
+			s.Log.Error(err, "full sync failed")
+			s.Reconciler.Router.Freeze(fmt.Sprintf("full sync failed: %v", err))
+		} else {
+			metrics.FullSyncs.WithLabelValues(metrics.ResultSuccess).Inc()
+			metrics.LastFullSync.SetToCurrentTime()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case interval := <-s.resyncCh():
+			if interval > 0 {
+				ticker.Reset(interval)
+				s.mu.Lock()
+				s.interval = interval
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// SyncAll compute the desired routes of all the BlockAffinities and apply them. The reconciles deferred
+// until the BlockAffinities are listed are covered by it, they are requeued when it fails
+func (s *Syncer) SyncAll(ctx context.Context) (err error) {
+	r := s.Reconciler
+	deferred := r.stopDeferring()
+	defer func() {
+		if err != nil {
+			r.retry(ctx, deferred)
+		}
+	}()
+	pools := enabledPools(r.IpPoolLister)
+	blockAffinityList := &calico.BlockAffinityList{}
+	if err := r.List(ctx, blockAffinityList); err != nil {
+		return err
+	}
+	var desired []*types.Route
+	skipped := map[string]int{}
+	flagged := map[string]int{}
+	states := map[string]int{}
+	perNode := map[string]int{}
+	for i := range blockAffinityList.Items {
+		ba := &blockAffinityList.Items[i]
+		// the route of a BlockAffinity deleted later is deleted by its reconcile, also when the startup one was deferred
+		r.rememberBlock(k8stypes.NamespacedName{Namespace: ba.Namespace, Name: ba.Name}, ba.Spec.CIDR)
+		if !ba.DeletionTimestamp.IsZero() {
+			continue
+		}
+		states[blockAffinityState(ba)]++
+		route, reason, err := r.desiredRoute(ba, pools)
+		if err != nil {
+			return err
+		}
+		if route == nil {
+			skipped[reason]++
+			continue
+		}
+		if reason != "" {
+			flagged[reason]++
+		}
+		perNode[ba.Spec.Node]++
+		desired = append(desired, route)
+	}
+	var borrowed int
+	if s.Borrowed != nil {
+		routes, err := s.borrowedRoutes(ctx, pools, perNode)
+		if err != nil {
+			return err
+		}
+		borrowed = len(routes)
+		desired = append(desired, routes...)
+	}
+	// a broken watch leaves the cache stale, the routes it would delete may still be in use
+	if broken := s.Watches.Broken(); len(broken) > 0 {
+		r.Router.Freeze(fmt.Sprintf("watch broken: %v", broken))
+	} else {
+		r.Router.Thaw()
+	}
+	var known []net.IPNet
+	if s.AllPools != nil {
+		if known, err = allPoolNets(s.AllPools); err != nil {
+			return err
+		}
+	}
+	result, err := r.Router.Sync(poolNets(pools), known, desired)
+	if err != nil {
+		return err
+	}
+	publishCounts(metrics.NodeRoutes, perNode)
+	publishCounts(metrics.BlockAffinities, states)
+	s.Log.Info("full sync finished", "blockaffinities", len(blockAffinityList.Items), "pools", len(pools),
+		"borrowed", borrowed, "summary", result.String(), "skipped", skipped, "flagged", flagged, "states", states)
+	// affinities stay pending or pendingDeletion only briefly while calico/node claims or releases the block
+	var transitional int
+	for state, count := range states {
+		if state != calico.StateConfirmed {
+			transitional += count
+		}
+	}
+	if transitional > 0 {
+		s.Log.Info("blockaffinities not confirmed are not routed", "count", transitional, "states", states)
+	}
+	return nil
+}
+
+// allPoolNets the cidrs of all the IPPools, also the disabled ones
+func allPoolNets(lister toolscache.GenericLister) ([]net.IPNet, error) {
+	list, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	nets := make([]net.IPNet, 0, len(list))
+	for _, obj := range list {
+		pool, err := toIPPool(obj)
+		if err != nil {
+			return nil, err
+		}
+		if n := util.ParseNet(pool.Spec.CIDR); n != nil {
+			nets = append(nets, *n)
+		}
+	}
+	return nets, nil
+}
+
+// borrowedRoutes the host routes of the borrowed addresses of all the IPAMBlocks
+func (s *Syncer) borrowedRoutes(ctx context.Context, pools []ipPool, perNode map[string]int) ([]*types.Route, error) {
+	blockList := &calico.IPAMBlockList{}
+	if err := s.Borrowed.List(ctx, blockList); err != nil {
+		return nil, err
+	}
+	var desired []*types.Route
+	for i := range blockList.Items {
+		block := &blockList.Items[i]
+		if block.Spec.Deleted || !block.DeletionTimestamp.IsZero() {
+			continue
+		}
+		routes, err := s.Borrowed.borrowedRoutes(block, pools, perNode)
+		if err != nil {
+			return nil, err
+		}
+		desired = append(desired, routes...)
+	}
+	return desired, nil
+}
+
+// publishCounts replace the values of the gauge by the counts, dropping the labels gone
+func publishCounts(gauge *prometheus.GaugeVec, counts map[string]int) {
+	gauge.Reset()
+	for label, count := range counts {
+		gauge.WithLabelValues(label).Set(float64(count))
+	}
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/selector"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testNodeLister a node lister holding the nodes with the addresses, a v4 and a v6 one at most
+func testNodeLister(t *testing.T, addresses map[string][]string) cache.GenericLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, ips := range addresses {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for _, ip := range ips {
+			node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip})
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = indexer.Add(&unstructured.Unstructured{Object: obj}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cache.NewGenericLister(indexer, schema.GroupResource{Resource: "nodes"})
+}
+
+func testPool(cidr string) ipPool {
+	nodeSelector, _ := selector.Parse("")
+	return ipPool{
+		IPPool:       calico.IPPool{Spec: calico.IPPoolSpec{CIDR: cidr}},
+		Net:          util.ParseNet(cidr),
+		NodeSelector: nodeSelector,
+	}
+}
+
+func testIPAMBlock(name, cidr, affinity string, deleted bool, allocations []int, nodes ...string) *calico.IPAMBlock {
+	block := &calico.IPAMBlock{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	block.Spec.CIDR = cidr
+	block.Spec.Deleted = deleted
+	if affinity != "" {
+		affinity = calico.IPAMBlockAffinityPrefix + affinity
+		block.Spec.Affinity = &affinity
+	}
+	// -1 a free address
+	for _, attr := range allocations {
+		if attr < 0 {
+			block.Spec.Allocations = append(block.Spec.Allocations, nil)
+			continue
+		}
+		attr := attr
+		block.Spec.Allocations = append(block.Spec.Allocations, &attr)
+	}
+	for _, node := range nodes {
+		secondary := map[string]string{}
+		if node != "" {
+			secondary[calico.IPAMBlockAttributeNode] = node
+		}
+		block.Spec.Attributes = append(block.Spec.Attributes, calico.AllocationAttribute{AttrSecondary: secondary})
+	}
+	return block
+}
+
+func testBlockAffinity(name, cidr, node string) *calico.BlockAffinity {
+	ba := &calico.BlockAffinity{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	ba.Spec.CIDR = cidr
+	ba.Spec.Node = node
+	ba.Spec.State = calico.StateConfirmed
+	return ba
+}
+
+// TestDesiredRoutesWithBorrowed the block routes of the BlockAffinities and the host routes of the
+// addresses borrowed from the IPAMBlocks, computed like SyncAll does
+func TestDesiredRoutesWithBorrowed(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := calico.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	objects := []client.Object{
+		testBlockAffinity("node-a-10-64-0-0-26", "10.64.0.0/26", "node-a"),
+		testBlockAffinity("node-b-10-64-0-64-26", "10.64.0.64/26", "node-b"),
+		testBlockAffinity("node-a-fd00-10-122", "fd00::/122", "node-a"),
+		// the addresses allocated to node-a itself are not borrowed, nor the free ones and those without a node
+		// or with an attribute out of range. node-gone is not found, node-filtered is filtered out and
+		// node-v6 has no address of the family
+		testIPAMBlock("10-64-0-0-26", "10.64.0.0/26", "node-a", false,
+			[]int{0, 1, -1, 2, 1, 3, 4, 5, 9}, "node-a", "node-b", "", "node-gone", "node-filtered", "node-v6"),
+		// a block without affinity lends all its allocated addresses
+		testIPAMBlock("10-64-0-64-26", "10.64.0.64/26", "", false, []int{0}, "node-b"),
+		testIPAMBlock("fd00-122", "fd00::/122", "node-a", false, []int{-1, -1, 0}, "node-v6"),
+		// a deleted block, a block out of the enabled pools and an invalid one lend nothing
+		testIPAMBlock("10-64-1-0-26", "10.64.1.0/26", "node-a", true, []int{0}, "node-b"),
+		testIPAMBlock("10-65-0-0-26", "10.65.0.0/26", "node-a", false, []int{0}, "node-b"),
+		testIPAMBlock("invalid", "10.64.2.0", "node-a", false, []int{0}, "node-b"),
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	nodes := testNodeLister(t, map[string][]string{
+		"node-a":        {"192.168.0.1", "fd10::1"},
+		"node-b":        {"192.168.0.2"},
+		"node-filtered": {"192.168.0.3"},
+		"node-v6":       {"fd10::4"},
+	})
+	settings := NewSettingsStore(Settings{NodeFilter: NodeFilter{Exclude: regexp.MustCompile("filtered")}})
+	s := &Syncer{
+		Reconciler: &BlockAffinityReconciler{Client: c, Log: logr.Discard(), NodeLister: nodes, Settings: settings},
+		Borrowed:   &IPAMBlockReconciler{Client: c, Log: logr.Discard(), NodeLister: nodes, Settings: settings},
+	}
+	pools := []ipPool{testPool("10.64.0.0/16"), testPool("fd00::/64")}
+
+	baList := &calico.BlockAffinityList{}
+	if err := c.List(context.Background(), baList); err != nil {
+		t.Fatal(err)
+	}
+	var desired []*types.Route
+	perNode := map[string]int{}
+	for i := range baList.Items {
+		route, reason, err := s.Reconciler.desiredRoute(&baList.Items[i], pools)
+		if err != nil || route == nil {
+			t.Fatalf("route of %s: %v, %s", baList.Items[i].Name, err, reason)
+		}
+		perNode[baList.Items[i].Spec.Node]++
+		desired = append(desired, route)
+	}
+	borrowed, err := s.borrowedRoutes(context.Background(), pools, perNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired = append(desired, borrowed...)
+
+	var got []string
+	for _, route := range desired {
+		got = append(got, route.DstNet.String()+" via "+route.GwIP.String())
+	}
+	sort.Strings(got)
+	want := []string{
+		"10.64.0.0/26 via 192.168.0.1",
+		"10.64.0.1/32 via 192.168.0.2",
+		"10.64.0.4/32 via 192.168.0.2",
+		"10.64.0.64/26 via 192.168.0.2",
+		"10.64.0.64/32 via 192.168.0.2",
+		"fd00::/122 via fd10::1",
+		"fd00::2/128 via fd10::4",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("desired routes %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("desired routes %v, want %v", got, want)
+			break
+		}
+	}
+	wantPerNode := map[string]int{"node-a": 2, "node-b": 4, "node-v6": 1}
+	if len(perNode) != len(wantPerNode) {
+		t.Errorf("routes per node %v, want %v", perNode, wantPerNode)
+	}
+	for node, count := range wantPerNode {
+		if perNode[node] != count {
+			t.Errorf("routes per node %v, want %v", perNode, wantPerNode)
+			break
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"k8s.io/client-go/tools/cache"
+	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WatchMonitor track the health of the apiserver watches of the informers: a watch is broken after
+// an error until the next event, the periodic resync delivers one even in a quiet cluster
+type WatchMonitor struct {
+	mu sync.Mutex
+	// brokenSince the time of the first error of the broken watches
+	brokenSince map[string]time.Time
+}
+
+// watchedInformer an informer whose watch can be monitored, the client-go informers
+// and those of the controller-runtime cache
+type watchedInformer interface {
+	SetWatchErrorHandler(handler cache.WatchErrorHandler) error
+	AddEventHandler(handler cache.ResourceEventHandler) (cache.ResourceEventHandlerRegistration, error)
+}
+
+// Monitor track the watch of the informer, must be called before the informer is started
+func (m *WatchMonitor) Monitor(informer watchedInformer, resource string) error {
+	m.healthy(resource)
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		metrics.WatchErrors.WithLabelValues(resource).Inc()
+		m.broken(resource)
+		cache.DefaultWatchErrorHandler(r, err)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { m.healthy(resource) },
+		UpdateFunc: func(interface{}, interface{}) { m.healthy(resource) },
+		DeleteFunc: func(interface{}) { m.healthy(resource) },
+	})
+	return err
+}
+
+// MonitorCache track the watch of the informer of obj in the controller-runtime cache,
+// must be called before the cache is started
+func (m *WatchMonitor) MonitorCache(ctx context.Context, c ctrlcache.Cache, obj client.Object, resource string) error {
+	informer, err := c.GetInformer(ctx, obj)
+	if err != nil {
+		return err
+	}
+	watched, ok := informer.(watchedInformer)
+	if !ok {
+		return fmt.Errorf("the informer of %s can not be monitored", resource)
+	}
+	return m.Monitor(watched, resource)
+}
+
+func (m *WatchMonitor) healthy(resource string) {
+	metrics.WatchHealthy.WithLabelValues(resource).Set(1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.brokenSince, resource)
+}
+
+func (m *WatchMonitor) broken(resource string) {
+	metrics.WatchHealthy.WithLabelValues(resource).Set(0)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.brokenSince == nil {
+		m.brokenSince = map[string]time.Time{}
+	}
+	if _, ok := m.brokenSince[resource]; !ok {
+		m.brokenSince[resource] = time.Now()
+	}
+}
+
+// Check fail when a watch is broken for longer than timeout
+func (m *WatchMonitor) Check(timeout time.Duration) error {
+	if broken := m.brokenFor(timeout); len(broken) > 0 {
+		return fmt.Errorf("watch broken: %v", broken)
+	}
+	return nil
+}
+
+// Broken the watches broken now, none for a nil monitor
+func (m *WatchMonitor) Broken() []string {
+	if m == nil {
+		return nil
+	}
+	return m.brokenFor(0)
+}
+
+// brokenFor the watches broken for longer than timeout, with the time of their first error
+func (m *WatchMonitor) brokenFor(timeout time.Duration) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var broken []string
+	for resource, since := range m.brokenSince {
+		if time.Since(since) >= timeout {
+			broken = append(broken, fmt.Sprintf("%s since %s", resource, since.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(broken)
+	return broken
+}
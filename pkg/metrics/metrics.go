@@ -0,0 +1,152 @@
+// Package metrics the prometheus metrics of calico-route-sync, served by the manager on --metrics-bind-address
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "calico_route_sync"
+
+// The result label values
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+var (
+	// DesiredRoutes the routes we want in the kernel
+	DesiredRoutes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "desired_routes",
+		Help:      "Number of routes calico-route-sync wants in the kernel.",
+	})
+	// InstalledRoutes the managed routes found in the kernel by the last full sync
+	InstalledRoutes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "installed_routes",
+		Help:      "Number of managed routes found in the kernel by the last full sync.",
+	})
+	// RouteOperations the route changes by operation (add, replace, delete) and result
+	RouteOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route_operations_total",
+		Help:      "Route changes by operation (add, replace, delete) and result (success, error).",
+	}, []string{"operation", "result"})
+	// DryRunOperations the route changes planned but not applied in dry-run mode
+	DryRunOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_operations_total",
+		Help:      "Route changes (add, replace, delete) planned but not applied, and routes refused (conflict), in dry-run mode.",
+	}, []string{"operation"})
+	// NetlinkErrors the failed netlink calls by call
+	NetlinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "netlink_errors_total",
+		Help:      "Failed netlink calls by call.",
+	}, []string{"call"})
+	// DriftRepairs the desired routes repaired after being changed or deleted by others
+	DriftRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_repairs_total",
+		Help:      "Desired routes repaired after being changed or deleted by others, by result.",
+	}, []string{"result"})
+	// FullSyncDuration the duration of the full syncs
+	FullSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "full_sync_duration_seconds",
+		Help:      "Duration of the full desired-state route syncs.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	// FullSyncs the full syncs by result
+	FullSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "full_syncs_total",
+		Help:      "Full desired-state route syncs by result.",
+	}, []string{"result"})
+	// SyncPendingChanges the route changes of the running full sync not applied yet
+	SyncPendingChanges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "full_sync_pending_changes",
+		Help:      "Route changes of the running full sync not applied yet, 0 between the full syncs.",
+	})
+	// LastFullSync the unix time of the last successful full sync
+	LastFullSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_full_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful full sync, alert on time() - calico_route_sync_last_full_sync_timestamp_seconds.",
+	})
+	// DeletesFrozen whether the route deletes are frozen
+	DeletesFrozen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deletes_frozen",
+		Help:      "1 while the route deletes are frozen for lack of a consistent view of the cluster.",
+	})
+	// DeletesBlocked the stale routes a tripped delete breaker keeps
+	DeletesBlocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deletes_blocked",
+		Help:      "Number of stale routes kept by the tripped delete breaker, 0 when it is closed. Alert on > 0.",
+	})
+	// DeleteBreakerTrips the full syncs refused by the delete breaker
+	DeleteBreakerTrips = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delete_breaker_trips_total",
+		Help:      "Full syncs whose deletes were refused by the delete breaker.",
+	})
+	// NodeRoutes the desired routes via each node
+	NodeRoutes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "node_routes",
+		Help:      "Number of desired routes via each node, as of the last full sync.",
+	}, []string{"node"})
+	// BlockAffinities the BlockAffinities by state
+	BlockAffinities = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "blockaffinities",
+		Help:      "Number of BlockAffinities by state, as of the last full sync.",
+	}, []string{"state"})
+	// WatchErrors the errors of the apiserver watches by resource
+	WatchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_errors_total",
+		Help:      "Errors of the apiserver watches by resource.",
+	}, []string{"resource"})
+	// WatchHealthy whether the apiserver watch of a resource works
+	WatchHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watch_healthy",
+		Help:      "1 when the apiserver watch of the resource works, 0 after an error until the next event.",
+	}, []string{"resource"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(
+		DesiredRoutes,
+		InstalledRoutes,
+		RouteOperations,
+		DryRunOperations,
+		NetlinkErrors,
+		DriftRepairs,
+		FullSyncDuration,
+		FullSyncs,
+		SyncPendingChanges,
+		LastFullSync,
+		DeletesFrozen,
+		DeletesBlocked,
+		DeleteBreakerTrips,
+		NodeRoutes,
+		BlockAffinities,
+		WatchErrors,
+		WatchHealthy,
+	)
+}
+
+// ObserveRouteOperation count a route change
+func ObserveRouteOperation(operation string, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultError
+	}
+	RouteOperations.WithLabelValues(operation, result).Inc()
+}
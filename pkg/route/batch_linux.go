@@ -0,0 +1,300 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// batchMessages the route messages sent in a single write
+	batchMessages = 128
+	// batchReceiveBuffer the receive buffer of the batch socket, it holds the errors of a whole write
+	batchReceiveBuffer = 4 << 20
+	// batchTimeout the wait for the errors of a write
+	batchTimeout = 10
+)
+
+// errBatchLost the outcome of a message is unknown, the socket failed before its ack
+var errBatchLost = errors.New("route batch: no ack from the kernel")
+
+// routeBatcher a netlink socket of its own sending the route messages in batches: only the last message
+// of a write asks for an ack, the kernel answers the others only when they fail
+type routeBatcher struct {
+	mu sync.Mutex
+	// fd the socket, opened on the first batch and again after it failed
+	fd   int
+	open bool
+}
+
+// batchOp a route message of a batch and what to do with its outcome
+type batchOp struct {
+	req   *nl.NetlinkRequest
+	route *netlink.Route
+	// linkName the interface of an added route
+	linkName string
+	// previous the routes replaced by an added route
+	previous []netlink.Route
+	replace  bool
+	del      bool
+	// err the error of the route or of the dst the message belongs to
+	err *error
+}
+
+// RouteBatch ensure the routes and delete the managed routes to the dsts like RouteEnsure and RouteDel,
+// the route messages are sent in batches
+func (n netlinkHandle) RouteBatch(localNetworks []types.LocalNetwork, routes []*types.Route, dsts []*net.IPNet) ([]error, []error) {
+	routeErrs := make([]error, len(routes))
+	dstErrs := make([]error, len(dsts))
+	var ops []*batchOp
+	for i, route := range routes {
+		action, previous, err := n.planEnsure(localNetworks, route)
+		if err != nil {
+			routeErrs[i] = err
+			continue
+		}
+		if action == ensureConflict {
+			routeErrs[i] = conflictError(route, previous)
+			metrics.ObserveRouteOperation("add", routeErrs[i])
+			continue
+		}
+		if n.useVXLAN(localNetworks, route) && (action != ensureNone || !n.vtepProgrammed(route.VTEP)) {
+			if routeErrs[i] = n.vtepEnsure(route.VTEP); routeErrs[i] != nil {
+				continue
+			}
+		}
+		if action == ensureNone {
+			continue
+		}
+		r, linkName, err := n.netlinkRoute(localNetworks, route)
+		if err != nil {
+			routeErrs[i] = err
+			continue
+		}
+		op := &batchOp{route: r, linkName: linkName, err: &routeErrs[i]}
+		if action == ensureReplace {
+			op.replace, op.previous = true, previous
+			op.req = routeMessage(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, r)
+		} else {
+			op.req = routeMessage(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r)
+		}
+		ops = append(ops, op)
+	}
+	for i, dst := range dsts {
+		current, err := n.managedRoutesTo(dst)
+		if err != nil {
+			dstErrs[i] = err
+			continue
+		}
+		for j := range current {
+			ops = append(ops, &batchOp{
+				req:   routeMessage(unix.RTM_DELROUTE, 0, &current[j]),
+				route: &current[j],
+				del:   true,
+				err:   &dstErrs[i],
+			})
+		}
+	}
+
+	reqs := make([]*nl.NetlinkRequest, len(ops))
+	for i, op := range ops {
+		reqs[i] = op.req
+	}
+	errs := n.batch.send(reqs)
+	for i, op := range ops {
+		var err error
+		switch {
+		case op.del:
+			err = n.routeDeleted(op.route, errs[i])
+			metrics.ObserveRouteOperation("delete", err)
+		case op.replace:
+			err = n.routeReplaced(op.route, op.linkName, op.previous, errs[i])
+			metrics.ObserveRouteOperation("replace", err)
+		default:
+			err = n.routeAdded(op.route, op.linkName, errs[i])
+			metrics.ObserveRouteOperation("add", err)
+		}
+		if err != nil && *op.err == nil {
+			*op.err = err
+		}
+	}
+	return routeErrs, dstErrs
+}
+
+// routeMessage the netlink request of a route change, the same message as the netlink package builds
+// for the attributes our routes use
+func routeMessage(msgType, flags int, r *netlink.Route) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(msgType, flags)
+	var msg *nl.RtMsg
+	if msgType == unix.RTM_DELROUTE {
+		msg = nl.NewRtDelMsg()
+	} else {
+		msg = nl.NewRtMsg()
+	}
+	family := unix.AF_INET
+	dst := r.Dst.IP.To4()
+	if dst == nil {
+		family = unix.AF_INET6
+		dst = r.Dst.IP.To16()
+	}
+	ones, _ := r.Dst.Mask.Size()
+	msg.Family = uint8(family)
+	msg.Dst_len = uint8(ones)
+	msg.Tos = uint8(r.Tos)
+	msg.Scope = uint8(r.Scope)
+	msg.Flags = uint32(r.Flags)
+	if r.Protocol > 0 {
+		msg.Protocol = uint8(r.Protocol)
+	}
+	if r.Type > 0 {
+		msg.Type = uint8(r.Type)
+	}
+	var attrs []*nl.RtAttr
+	if r.Table > 0 {
+		if r.Table >= 256 {
+			msg.Table = unix.RT_TABLE_UNSPEC
+			attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(r.Table))))
+		} else {
+			msg.Table = uint8(r.Table)
+		}
+	}
+	attrs = append(attrs, nl.NewRtAttr(unix.RTA_DST, dst))
+	if r.Gw != nil {
+		gw := r.Gw.To4()
+		if family == unix.AF_INET6 {
+			gw = r.Gw.To16()
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, gw))
+	}
+	if r.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(r.Priority))))
+	}
+	if r.Realm > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_FLOW, nl.Uint32Attr(uint32(r.Realm))))
+	}
+	if r.LinkIndex > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_OIF, nl.Uint32Attr(uint32(r.LinkIndex))))
+	}
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	return req
+}
+
+// send the requests in writes of batchMessages, returns the error of each request
+func (b *routeBatcher) send(reqs []*nl.NetlinkRequest) []error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	errs := make([]error, len(reqs))
+	for start := 0; start < len(reqs); start += batchMessages {
+		end := start + batchMessages
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		if err := b.write(reqs[start:end], errs[start:end]); err != nil {
+			metrics.NetlinkErrors.WithLabelValues("route_batch").Inc()
+			klog.Errorf("route batch err: %v", err)
+			b.close()
+		}
+	}
+	return errs
+}
+
+// write the requests in a single write and collect their errors, the last request asks for an ack.
+// When the socket fails the requests without an outcome get errBatchLost
+func (b *routeBatcher) write(reqs []*nl.NetlinkRequest, errs []error) error {
+	pending := make(map[uint32]int, len(reqs))
+	var buf []byte
+	for i, req := range reqs {
+		if i == len(reqs)-1 {
+			req.Flags |= unix.NLM_F_ACK
+		}
+		pending[req.Seq] = i
+		buf = append(buf, req.Serialize()...)
+	}
+	lost := func(err error) error {
+		for _, i := range pending {
+			errs[i] = fmt.Errorf("%w: %v", errBatchLost, err)
+		}
+		return err
+	}
+	if err := b.dial(); err != nil {
+		return lost(err)
+	}
+	if err := unix.Sendto(b.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return lost(err)
+	}
+	last := reqs[len(reqs)-1].Seq
+	rb := make([]byte, unix.Getpagesize())
+	for {
+		nr, _, err := unix.Recvfrom(b.fd, rb, 0)
+		if err != nil {
+			return lost(err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:nr])
+		if err != nil {
+			return lost(err)
+		}
+		for _, m := range msgs {
+			i, ok := pending[m.Header.Seq]
+			if !ok || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			delete(pending, m.Header.Seq)
+			if len(m.Data) < 4 {
+				errs[i] = errors.New("route batch: truncated netlink error")
+			} else if code := int32(nl.NativeEndian().Uint32(m.Data[:4])); code != 0 {
+				errs[i] = syscall.Errno(-code)
+			}
+			if m.Header.Seq == last {
+				// the kernel handles the messages of a write in order, no error is left to come
+				return nil
+			}
+		}
+	}
+}
+
+// dial open the socket unless it is open
+func (b *routeBatcher) dial() error {
+	if b.open {
+		return nil
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	// the errors only carry the header of the failed message
+	_ = unix.SetsockoptInt(fd, unix.SOL_NETLINK, unix.NETLINK_CAP_ACK, 1)
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, batchReceiveBuffer); err != nil {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, batchReceiveBuffer)
+	}
+	tv := unix.Timeval{Sec: batchTimeout}
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	b.fd, b.open = fd, true
+	return nil
+}
+
+// close the socket, the next batch opens another one
+func (b *routeBatcher) close() {
+	if b.open {
+		unix.Close(b.fd)
+		b.open = false
+	}
+}
@@ -0,0 +1,233 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// testNetns run the test in a network namespace of its own holding the veth eth0 on 10.9.0.1/24
+func testNetns(t *testing.T) []types.LocalNetwork {
+	t.Helper()
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("get network namespace: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		t.Skipf("network namespace not permitted: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(origin)
+		ns.Close()
+		origin.Close()
+		runtime.UnlockOSThread()
+	})
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}, PeerName: "eth1"}
+	if err = netlink.LinkAdd(link); err != nil {
+		t.Skipf("add link: %v", err)
+	}
+	nodes := util.ParseNet("10.9.0.0/24")
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: util.NthIP(nodes, 1), Mask: nodes.Mask}}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		t.Fatalf("add address: %v", err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		t.Fatalf("set link up: %v", err)
+	}
+	return []types.LocalNetwork{{
+		LinkName: "eth0",
+		LocalIp4: []types.IP4{{Net: nodes, IP: util.NthIP(nodes, 1)}},
+	}}
+}
+
+// testKernelRoute add a route via the node 10.9.0.x
+func testKernelRoute(t *testing.T, dst string, node int, protocol netlink.RouteProtocol) {
+	t.Helper()
+	link, err := netlink.LinkByName("eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &netlink.Route{
+		Dst:       util.ParseNet(dst),
+		Gw:        util.NthIP(util.ParseNet("10.9.0.0/24"), node),
+		LinkIndex: link.Attrs().Index,
+		Protocol:  protocol,
+	}
+	if err = netlink.RouteAdd(r); err != nil {
+		t.Fatalf("add route [%s]: %v", dst, err)
+	}
+}
+
+// kernelRoutes the gateways of the routes of the main table by dst
+func kernelRoutes(t *testing.T) map[string]string {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gws := map[string]string{}
+	for _, r := range routes {
+		if r.Dst != nil && r.Gw != nil {
+			gws[r.Dst.String()] = r.Gw.String()
+		}
+	}
+	return gws
+}
+
+func TestRouteBatch(t *testing.T) {
+	local := testNetns(t)
+	opts := Options{Protocol: types.DefaultRouteProtocol}
+	n := newNetLinkHandle(opts, newRouteView(opts.table()))
+
+	testKernelRoute(t, "10.64.0.0/26", 3, types.DefaultRouteProtocol)
+	testKernelRoute(t, "10.65.0.0/26", 3, types.DefaultRouteProtocol)
+	testKernelRoute(t, "10.66.0.0/26", 3, unix.RTPROT_STATIC)
+
+	// more routes than a single write holds
+	pool := util.ParseNet("10.64.0.0/16")
+	gw := util.NthIP(util.ParseNet("10.9.0.0/24"), 2)
+	var routes []*types.Route
+	for i := 0; i < 2*batchMessages+10; i++ {
+		dst := &net.IPNet{IP: util.NthIP(pool, i*64), Mask: net.CIDRMask(26, 32)}
+		routes = append(routes, &types.Route{DstNet: dst, GwIP: gw})
+	}
+	routes = append(routes,
+		&types.Route{DstNet: util.ParseNet("10.66.0.0/26"), GwIP: gw},
+		&types.Route{DstNet: util.ParseNet("10.67.0.0/26"), GwIP: net.ParseIP("10.10.0.2")})
+	dsts := []*net.IPNet{util.ParseNet("10.65.0.0/26"), util.ParseNet("10.68.0.0/26")}
+
+	routeErrs, dstErrs := n.RouteBatch(local, routes, dsts)
+	for i, err := range routeErrs[:len(routeErrs)-2] {
+		if err != nil {
+			t.Errorf("ensure route [%s]: %v", routes[i].DstNet, err)
+		}
+	}
+	if err := routeErrs[len(routeErrs)-2]; err == nil {
+		t.Errorf("a route of others is overwritten")
+	}
+	if err := routeErrs[len(routeErrs)-1]; err == nil {
+		t.Errorf("a route via a node out of the local networks is installed")
+	}
+	for i, err := range dstErrs {
+		if err != nil {
+			t.Errorf("delete [%s]: %v", dsts[i], err)
+		}
+	}
+
+	gws := kernelRoutes(t)
+	for _, route := range routes[:len(routes)-2] {
+		if got := gws[route.DstNet.String()]; got != gw.String() {
+			t.Errorf("route [%s] via [%s], want [%s]", route.DstNet, got, gw)
+		}
+	}
+	if got := gws["10.66.0.0/26"]; got != "10.9.0.3" {
+		t.Errorf("the route of others via [%s], want 10.9.0.3", got)
+	}
+	for _, dst := range []string{"10.65.0.0/26", "10.67.0.0/26"} {
+		if got, ok := gws[dst]; ok {
+			t.Errorf("route [%s] via [%s] installed", dst, got)
+		}
+	}
+}
+
+// TestRouteBatchIPv6 the ipv6 routes are held in the view with the metric of the kernel, then replaced
+// in place and deleted without error
+func TestRouteBatchIPv6(t *testing.T) {
+	local := testNetns6(t)
+	opts := Options{Protocol: types.DefaultRouteProtocol}
+	view := newRouteView(opts.table())
+	if err := view.reload(); err != nil {
+		t.Fatal(err)
+	}
+	n := newNetLinkHandle(opts, view)
+
+	gw := net.ParseIP("fd09::2")
+	var routes []*types.Route
+	for _, dst := range []string{"fd00::/122", "fd00::40/122", "fd00::80/122"} {
+		routes = append(routes, &types.Route{DstNet: util.ParseNet(dst), GwIP: gw})
+	}
+	routeErrs, _ := n.RouteBatch(local, routes, nil)
+	for i, err := range routeErrs {
+		if err != nil {
+			t.Errorf("add route [%s]: %v", routes[i].DstNet, err)
+		}
+	}
+	kernel := newRouteView(opts.table())
+	if err := kernel.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range routes {
+		held, _ := view.to(route.DstNet)
+		installed, _ := kernel.to(route.DstNet)
+		if len(held) != 1 || len(installed) != 1 {
+			t.Errorf("route [%s] held as %v, installed as %v", route.DstNet, held, installed)
+		} else if held[0].Priority != installed[0].Priority {
+			t.Errorf("route [%s] held with metric %d, installed with %d", route.DstNet, held[0].Priority, installed[0].Priority)
+		}
+		if action, _, err := n.planEnsure(local, route); err != nil || action != ensureNone {
+			t.Errorf("route [%s] planned again: %v, %v", route.DstNet, action, err)
+		}
+	}
+
+	replaced := &types.Route{DstNet: routes[0].DstNet, GwIP: net.ParseIP("fd09::3")}
+	routeErrs, dstErrs := n.RouteBatch(local, []*types.Route{replaced}, []*net.IPNet{routes[1].DstNet})
+	if routeErrs[0] != nil || dstErrs[0] != nil {
+		t.Errorf("replace route: %v, delete route: %v", routeErrs[0], dstErrs[0])
+	}
+	gws := kernelRoutes6(t)
+	if got := gws["fd00::/122"]; len(got) != 1 || got[0] != "fd09::3" {
+		t.Errorf("route [fd00::/122] via %v, want fd09::3", got)
+	}
+	if got, ok := gws["fd00::40/122"]; ok {
+		t.Errorf("route [fd00::40/122] via %v installed", got)
+	}
+	if held, _ := view.to(routes[0].DstNet); len(held) != 1 || !held[0].Gw.Equal(replaced.GwIP) {
+		t.Errorf("replaced route held as %v", held)
+	}
+}
+
+// TestRouteBatcherErrors a failed message does not fail the others of its write
+func TestRouteBatcherErrors(t *testing.T) {
+	testNetns(t)
+	link, err := netlink.LinkByName("eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []*nl.NetlinkRequest
+	for i := 0; i < 5; i++ {
+		r := &netlink.Route{
+			Dst:       util.ParseNet(fmt.Sprintf("10.64.%d.0/24", i%3)),
+			Gw:        net.ParseIP("10.9.0.2"),
+			LinkIndex: link.Attrs().Index,
+			Protocol:  types.DefaultRouteProtocol,
+		}
+		reqs = append(reqs, routeMessage(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r))
+	}
+	b := &routeBatcher{}
+	defer b.close()
+	errs := b.send(reqs)
+	want := []error{nil, nil, nil, syscall.EEXIST, syscall.EEXIST}
+	for i := range errs {
+		if errs[i] != want[i] {
+			t.Errorf("message %d err: %v, want %v", i, errs[i], want[i])
+		}
+	}
+	gws := kernelRoutes(t)
+	for i := 0; i < 3; i++ {
+		if dst := fmt.Sprintf("10.64.%d.0/24", i); gws[dst] != "10.9.0.2" {
+			t.Errorf("route [%s] not installed", dst)
+		}
+	}
+}
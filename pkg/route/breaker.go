@@ -0,0 +1,85 @@
+package route
+
+import (
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"k8s.io/klog/v2"
+)
+
+// deleteBreaker refuse a full sync deleting too many of the managed routes at once, e.g. computed from
+// a wrongly empty view of the cluster. The deletes proceed once the next full sync plans them again,
+// or after an operator override
+type deleteBreaker struct {
+	// maxFraction maxCount the most routes deleted in one pass, as a fraction of the managed routes
+	// and as a count, 0 means no limit
+	maxFraction float64
+	maxCount    int
+	// pending the deletes refused by the last full sync
+	pending map[string]bool
+	// override allow the deletes of the next full sync whatever their number
+	override bool
+}
+
+// exceeded whether deleting stale of the installed managed routes is too many
+func (b *deleteBreaker) exceeded(stale, installed int) bool {
+	if stale == 0 {
+		return false
+	}
+	if b.maxCount > 0 && stale > b.maxCount {
+		return true
+	}
+	return b.maxFraction > 0 && float64(stale) > b.maxFraction*float64(installed)
+}
+
+// allow whether the stale routes of a full sync can be deleted, r.mu must be held
+func (b *deleteBreaker) allow(stale []string, installed int) bool {
+	if !b.exceeded(len(stale), installed) {
+		b.reset()
+		return true
+	}
+	if b.override {
+		klog.Warningf("delete breaker overridden, delete %d of %d managed routes", len(stale), installed)
+		b.reset()
+		return true
+	}
+	if b.confirms(stale) {
+		klog.Warningf("delete breaker confirmed by a second full sync, delete %d of %d managed routes", len(stale), installed)
+		b.reset()
+		return true
+	}
+	b.pending = make(map[string]bool, len(stale))
+	for _, key := range stale {
+		b.pending[key] = true
+	}
+	metrics.DeleteBreakerTrips.Inc()
+	metrics.DeletesBlocked.Set(float64(len(stale)))
+	klog.Errorf("delete breaker tripped: the full sync would delete %d of %d managed routes, "+
+		"the deletes wait for the next full sync to confirm them or an override", len(stale), installed)
+	return false
+}
+
+// confirms whether the refused deletes are planned again, and nothing else
+func (b *deleteBreaker) confirms(stale []string) bool {
+	if b.pending == nil {
+		return false
+	}
+	for _, key := range stale {
+		if !b.pending[key] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *deleteBreaker) reset() {
+	b.pending = nil
+	b.override = false
+	metrics.DeletesBlocked.Set(0)
+}
+
+// OverrideDeleteBreaker allow the deletes of the next full sync, whatever their number
+func (r *Router) OverrideDeleteBreaker() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	klog.Warningf("delete breaker override requested, the next full sync deletes every stale route")
+	r.breaker.override = true
+}
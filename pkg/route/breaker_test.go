@@ -0,0 +1,74 @@
+package route
+
+import "testing"
+
+func TestDeleteBreakerExceeded(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxFraction      float64
+		maxCount         int
+		stale, installed int
+		want             bool
+	}{
+		{"nothing stale", 0.5, 1, 0, 0, false},
+		{"no limit", 0, 0, 100, 100, false},
+		{"under the fraction", 0.5, 0, 5, 10, false},
+		{"over the fraction", 0.5, 0, 6, 10, true},
+		{"nothing installed", 0.5, 0, 1, 0, true},
+		{"under the count", 0, 5, 5, 10, false},
+		{"over the count", 0, 5, 6, 100, true},
+		{"over the count under the fraction", 0.9, 5, 6, 100, true},
+		{"over the fraction under the count", 0.1, 50, 20, 100, true},
+	}
+	for _, tt := range tests {
+		b := &deleteBreaker{maxFraction: tt.maxFraction, maxCount: tt.maxCount}
+		if got := b.exceeded(tt.stale, tt.installed); got != tt.want {
+			t.Errorf("%s: exceeded(%d, %d) = %v, want %v", tt.name, tt.stale, tt.installed, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteBreakerAllow(t *testing.T) {
+	b := &deleteBreaker{maxCount: 2}
+	stale := []string{"10.64.0.0/26", "10.64.0.64/26", "10.64.0.128/26"}
+
+	if !b.allow(stale[:2], 10) || b.pending != nil {
+		t.Fatalf("deletes under the limit refused, pending %v", b.pending)
+	}
+	if b.allow(stale, 10) {
+		t.Fatalf("deletes over the limit allowed")
+	}
+	if len(b.pending) != len(stale) {
+		t.Errorf("pending %v, want %v", b.pending, stale)
+	}
+	// the next full sync plans other deletes, refused again
+	other := []string{"10.64.0.0/26", "10.64.0.64/26", "10.65.0.0/26"}
+	if b.confirms(other) || b.allow(other, 10) {
+		t.Fatalf("other deletes allowed")
+	}
+	// then plans the same deletes, or some of them
+	if !b.confirms(other[1:]) || !b.allow(other[1:], 10) {
+		t.Fatalf("confirmed deletes refused")
+	}
+	if b.pending != nil {
+		t.Errorf("pending %v once confirmed", b.pending)
+	}
+	if b.confirms(nil) {
+		t.Errorf("confirms without pending deletes")
+	}
+
+	b.override = true
+	if !b.allow(stale, 10) {
+		t.Fatalf("overridden deletes refused")
+	}
+	if b.override || b.pending != nil {
+		t.Errorf("override %v, pending %v once overridden", b.override, b.pending)
+	}
+	if b.allow(stale, 10) {
+		t.Errorf("the override applies to a single full sync")
+	}
+	b.reset()
+	if b.pending != nil || b.override {
+		t.Errorf("pending %v, override %v once reset", b.pending, b.override)
+	}
+}
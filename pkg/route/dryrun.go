@@ -0,0 +1,118 @@
+package route
+
+import (
+	"net"
+
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// dryRunHandle a NetLinkHandle which reads the kernel state through the wrapped handle,
+// but only logs and counts the changes it would make
+type dryRunHandle struct {
+	*netlinkHandle
+}
+
+func newDryRunHandle(handle *netlinkHandle) NetLinkHandle {
+	return &dryRunHandle{netlinkHandle: handle}
+}
+
+// planned log and count a change which is not applied
+func planned(operation string, format string, args ...interface{}) {
+	metrics.DryRunOperations.WithLabelValues(operation).Inc()
+	klog.Infof("dry-run: would "+format, args...)
+}
+
+// RouteEnsure the decision of the real handle, a route of others is refused like it would be
+func (d *dryRunHandle) RouteEnsure(localNetworks []types.LocalNetwork, route *types.Route) error {
+	action, routes, err := d.planEnsure(localNetworks, route)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case ensureConflict:
+		err = conflictError(route, routes)
+		planned("conflict", "refuse route [%s] via [%s]: %v", route.DstNet, route.GwIP, err)
+		return err
+	case ensureAdd:
+		planned("add", "add route [%s] via [%s]", route.DstNet, route.GwIP)
+	case ensureReplace:
+		planned("replace", "replace route [%s] via [%s]", route.DstNet, route.GwIP)
+	}
+	return nil
+}
+
+// RouteBatch the plan of each route and dst, nothing is sent
+func (d *dryRunHandle) RouteBatch(localNetworks []types.LocalNetwork, routes []*types.Route, dsts []*net.IPNet) ([]error, []error) {
+	routeErrs := make([]error, len(routes))
+	for i, route := range routes {
+		routeErrs[i] = d.RouteEnsure(localNetworks, route)
+	}
+	dstErrs := make([]error, len(dsts))
+	for i, dst := range dsts {
+		dstErrs[i] = d.RouteDel(&types.Route{DstNet: dst})
+	}
+	return routeErrs, dstErrs
+}
+
+func (d *dryRunHandle) RouteAdd(_ []types.LocalNetwork, route *types.Route) error {
+	planned("add", "add route [%s] via [%s]", route.DstNet, route.GwIP)
+	return nil
+}
+
+func (d *dryRunHandle) RouteDel(route *types.Route) error {
+	routes, err := d.ManagedRoutes([]net.IPNet{*route.DstNet})
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if equalIPNet(routes[i].Dst, route.DstNet) {
+			planned("delete", "del route [%s] via [%s]", routes[i].Dst, routes[i].Gw)
+		}
+	}
+	return nil
+}
+
+func (d *dryRunHandle) RouteDelNet(pool *net.IPNet) error {
+	routes, err := d.ManagedRoutes([]net.IPNet{*pool})
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		planned("delete", "del route [%s] via [%s]", routes[i].Dst, routes[i].Gw)
+	}
+	return nil
+}
+
+func (d *dryRunHandle) RouteCheckAndDel(localNetworks []types.LocalNetwork, route *types.Route) error {
+	if !d.RouteExist(localNetworks, route) {
+		return nil
+	}
+	return d.RouteDel(route)
+}
+
+func (d *dryRunHandle) TunnelEnsure() error {
+	klog.Infof("dry-run: would ensure the tunnel devices")
+	return nil
+}
+
+func (d *dryRunHandle) VTEPSync(vteps []*types.VTEP) error {
+	klog.Infof("dry-run: would sync the neighbour and fdb entries of %d vteps", len(vteps))
+	return nil
+}
+
+func (d *dryRunHandle) RuleEnsure(pools []net.IPNet) error {
+	klog.V(4).Infof("dry-run: would sync the ip rules of %d pools", len(pools))
+	return nil
+}
+
+func (d *dryRunHandle) RuleAddMissing(pools []net.IPNet) error {
+	klog.V(4).Infof("dry-run: would add the missing ip rules of %d pools", len(pools))
+	return nil
+}
+
+func (d *dryRunHandle) RuleClean() error {
+	klog.Infof("dry-run: would delete the ip rules")
+	return nil
+}
@@ -6,13 +6,25 @@ import (
 	"net"
 )
 
+// NetLinkHandle only ever touches the routes carrying our protocol marker,
+// plus the unmarked routes when adoption is enabled
 type NetLinkHandle interface {
+	// CalicoRoutes the managed routes contained in nets
 	CalicoRoutes(nets []net.IPNet) []netlink.Route
+	// ManagedRoutes a single snapshot of the managed routes contained in nets
+	ManagedRoutes(nets []net.IPNet) ([]netlink.Route, error)
+	// OrphanRoutes the routes carrying our marker outside every one of the pools
+	OrphanRoutes(pools []net.IPNet) ([]netlink.Route, error)
+	// InstalledRoutes the desired routes the managed routes contained in nets install,
+	// the ones we would not install that way are skipped
+	InstalledRoutes(localNetworks []types.LocalNetwork, nets []net.IPNet) ([]*types.Route, error)
+	// RouteMatch Whether the kernel route is ours and already is the desired route
+	RouteMatch(localNetworks []types.LocalNetwork, localRoute *netlink.Route, route *types.Route) bool
 	// RouteExist Determine whether the route exists
 	RouteExist(localNetworks []types.LocalNetwork, route *types.Route) bool
 	// RouteConflict When dst is the same, but gw or linkName is different, we consider routing conflict
 	RouteConflict(localNetworks []types.LocalNetwork, route *types.Route) bool
-	// RouteDel delete a single route
+	// RouteDel delete the managed routes to route.DstNet
 	RouteDel(route *types.Route) error
 	// RouteDelNet Batch delete the routes contained in the net
 	RouteDelNet(net *net.IPNet) error
@@ -20,6 +32,19 @@ type NetLinkHandle interface {
 	RouteAdd(localNetworks []types.LocalNetwork, route *types.Route) error
 	// RouteEnsure Check whether there is a route, create it if it does not exist, and update it if there is a conflict
 	RouteEnsure(localNetworks []types.LocalNetwork, route *types.Route) error
+	// RouteBatch ensure the routes and delete the managed routes to the dsts, the changes are sent as
+	// batches of netlink messages. Returns the error of each route and of each dst
+	RouteBatch(localNetworks []types.LocalNetwork, routes []*types.Route, dsts []*net.IPNet) ([]error, []error)
 	// RouteCheckAndDel Check if the route exists and delete it
 	RouteCheckAndDel(localNetworks []types.LocalNetwork, route *types.Route) error
+	// TunnelEnsure create and bring up the enabled tunnel devices
+	TunnelEnsure() error
+	// VTEPSync Make the neighbour and fdb entries of the vxlan device match the vteps exactly
+	VTEPSync(vteps []*types.VTEP) error
+	// RuleEnsure Make the ip rules of a dedicated table match the pools exactly, no-op for the main table
+	RuleEnsure(pools []net.IPNet) error
+	// RuleAddMissing add the missing ip rules of the pools, the other rules are left alone
+	RuleAddMissing(pools []net.IPNet) error
+	// RuleClean delete all the ip rules of a dedicated table
+	RuleClean() error
 }
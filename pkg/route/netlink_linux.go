@@ -4,35 +4,276 @@ import (
 	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
 	"github.com/yzxiu/calico-route-sync/pkg/types"
 	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog/v2"
 	"net"
 )
 
 type netlinkHandle struct {
-	netlink.Handle
+	// Handle a single netlink socket shared by all the requests
+	*netlink.Handle
+	// protocol and realm mark the routes installed by us
+	protocol netlink.RouteProtocol
+	realm    int
+	// adoptUnmarked take over the unmarked routes (proto boot/static)
+	adoptUnmarked bool
+	// table the routing table holding the routes, main by default
+	table        int
+	rulePriority int
+	// ipip route the blocks of the pools with IPIPMode set through the tunnel device
+	ipip    bool
+	ipipMTU int
+	// vxlan route the blocks of the pools with VXLANMode set through the vxlan device
+	vxlan     bool
+	vxlanMTU  int
+	vxlanVNI  int
+	vxlanPort int
+	// view the in-memory routes and links, the kernel is asked when it is not current
+	view *routeView
+	// vteps the vteps programmed on the vxlan device
+	vteps *vtepCache
+	// batch the socket of the batched route changes of the full sync
+	batch *routeBatcher
 }
 
-func NewNetLinkHandle() NetLinkHandle {
-	return &netlinkHandle{netlink.Handle{}}
+func NewNetLinkHandle(opts Options) NetLinkHandle {
+	return newNetLinkHandle(opts, newRouteView(opts.table()))
+}
+
+func newNetLinkHandle(opts Options, view *routeView) *netlinkHandle {
+	handle, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+	if err != nil {
+		klog.Errorf("open netlink socket err: %v, use a socket per request", err)
+		handle = &netlink.Handle{}
+	}
+	return &netlinkHandle{
+		Handle:        handle,
+		protocol:      netlink.RouteProtocol(opts.Protocol),
+		realm:         opts.Realm,
+		adoptUnmarked: opts.AdoptUnmarked,
+		table:         opts.table(),
+		rulePriority:  opts.RulePriority,
+		ipip:          opts.IPIP,
+		ipipMTU:       opts.IPIPMTU,
+		vxlan:         opts.VXLAN,
+		vxlanMTU:      opts.VXLANMTU,
+		vxlanVNI:      opts.VXLANVNI,
+		vxlanPort:     opts.VXLANPort,
+		view:          view,
+		vteps:         &vtepCache{},
+		batch:         &routeBatcher{},
+	}
+}
+
+// dumpAttempts the attempts of a route dump interrupted by routes changing meanwhile
+const dumpAttempts = 5
+
+// ip6DefaultPriority the metric the kernel gives an ipv6 route without one
+const ip6DefaultPriority = 1024
+
+// listRoutes list the routes of our table
+func (n netlinkHandle) listRoutes(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	if filter == nil {
+		filter = &netlink.Route{}
+	}
+	filter.Table = n.table
+	return routeListFiltered(n.Handle, family, filter, filterMask|netlink.RT_FILTER_TABLE)
+}
+
+// routeListFiltered dump the routes, again while the dump is interrupted by routes changing meanwhile:
+// the partial result of an interrupted dump can miss routes
+func routeListFiltered(h *netlink.Handle, family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	var err error
+	for attempt := 1; attempt <= dumpAttempts; attempt++ {
+		var routes []netlink.Route
+		routes, err = h.RouteListFiltered(family, filter, filterMask)
+		if !errors.Is(err, netlink.ErrDumpInterrupted) {
+			if err != nil {
+				metrics.NetlinkErrors.WithLabelValues("route_list").Inc()
+			}
+			return routes, err
+		}
+		klog.V(4).Infof("route dump interrupted, attempt %d/%d", attempt, dumpAttempts)
+	}
+	metrics.NetlinkErrors.WithLabelValues("route_list").Inc()
+	return nil, err
+}
+
+// owned Whether the route carries our marker
+func (n netlinkHandle) owned(r *netlink.Route) bool {
+	if r.Protocol != n.protocol {
+		return false
+	}
+	return n.realm == 0 || r.Realm == n.realm
+}
+
+// managed Whether the route can be touched by us, the owned routes,
+// and the unmarked routes when adoption is enabled
+func (n netlinkHandle) managed(r *netlink.Route) bool {
+	if n.owned(r) {
+		return true
+	}
+	return n.adoptUnmarked && (r.Protocol == unix.RTPROT_BOOT || r.Protocol == unix.RTPROT_STATIC)
+}
+
+// routesTo the routes of our table to the dst, ours and the others
+func (n netlinkHandle) routesTo(dst *net.IPNet) ([]netlink.Route, error) {
+	if routes, ok := n.view.to(dst); ok {
+		return routes, nil
+	}
+	return n.listRoutes(util.IPFamily(dst.IP), &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+}
+
+// linkName the name of the link, cached while the link updates are followed
+func (n netlinkHandle) linkName(index int) (string, error) {
+	if name, ok := n.view.linkName(index); ok {
+		return name, nil
+	}
+	link, err := n.LinkByIndex(index)
+	if err != nil {
+		return "", err
+	}
+	n.view.setLinkName(index, link.Attrs().Name)
+	return link.Attrs().Name, nil
+}
+
+// linkIndex the index of the link, cached while the link updates are followed
+func (n netlinkHandle) linkIndex(name string) (int, error) {
+	if index, ok := n.view.linkIndex(name); ok {
+		return index, nil
+	}
+	link, err := n.LinkByName(name)
+	if err != nil {
+		return 0, err
+	}
+	n.view.setLinkName(link.Attrs().Index, name)
+	return link.Attrs().Index, nil
+}
+
+// familyRoutes the routes of our table of the family, without the unmarked ones unless adopted
+func (n netlinkHandle) familyRoutes(family int) ([]netlink.Route, error) {
+	if routes, ok := n.view.all(family); ok {
+		return routes, nil
+	}
+	if n.adoptUnmarked {
+		return n.listRoutes(family, nil, 0)
+	}
+	return n.listRoutes(family, &netlink.Route{Protocol: n.protocol}, netlink.RT_FILTER_PROTOCOL)
+}
+
+// managedRoutes list the managed routes of the family
+func (n netlinkHandle) managedRoutes(family int) ([]netlink.Route, error) {
+	routes, err := n.familyRoutes(family)
+	if err != nil {
+		return nil, err
+	}
+	// filtered in place, the routes are a copy
+	managed := routes[:0]
+	for i := range routes {
+		if n.managed(&routes[i]) {
+			managed = append(managed, routes[i])
+		}
+	}
+	return managed, nil
 }
 
 func (n netlinkHandle) CalicoRoutes(pools []net.IPNet) []netlink.Route {
-	routes, err := n.RouteList(nil, netlink.FAMILY_V4)
-	var calicoRoutes []netlink.Route
+	calicoRoutes, err := n.ManagedRoutes(pools)
 	if err != nil {
-		klog.Error("get routes err: %v", err)
+		klog.Errorf("get routes err: %v", err)
 		return nil
 	}
-	for _, r := range routes {
-		for _, pool := range pools {
-			if r.Dst != nil && util.ContainsCIDR(&pool, r.Dst) {
-				calicoRoutes = append(calicoRoutes, r)
+	return calicoRoutes
+}
+
+func (n netlinkHandle) ManagedRoutes(pools []net.IPNet) ([]netlink.Route, error) {
+	routes, err := n.managedRoutes(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	calicoRoutes := routes[:0]
+	for i := range routes {
+		if routes[i].Dst != nil && util.ContainedInAny(pools, routes[i].Dst) {
+			calicoRoutes = append(calicoRoutes, routes[i])
+		}
+	}
+	return calicoRoutes, nil
+}
+
+func (n netlinkHandle) OrphanRoutes(pools []net.IPNet) ([]netlink.Route, error) {
+	routes, err := n.managedRoutes(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	// the unmarked routes outside the pools are not ours to delete, even when adopted
+	orphans := routes[:0]
+	for i := range routes {
+		if routes[i].Dst != nil && n.owned(&routes[i]) && !util.ContainedInAny(pools, routes[i].Dst) {
+			orphans = append(orphans, routes[i])
+		}
+	}
+	return orphans, nil
+}
+
+func (n netlinkHandle) InstalledRoutes(localNetworks []types.LocalNetwork, nets []net.IPNet) ([]*types.Route, error) {
+	routes, err := n.ManagedRoutes(nets)
+	if err != nil {
+		return nil, err
+	}
+	var vteps map[string]*types.VTEP
+	if n.vxlan {
+		if vteps, err = n.installedVTEPs(); err != nil {
+			return nil, err
+		}
+	}
+	installed := make([]*types.Route, 0, len(routes))
+	for i := range routes {
+		localRoute := &routes[i]
+		if localRoute.Gw == nil {
+			continue
+		}
+		linkName, err := n.linkName(localRoute.LinkIndex)
+		if err != nil {
+			continue
+		}
+		route := &types.Route{DstNet: localRoute.Dst, GwIP: localRoute.Gw}
+		switch linkName {
+		case types.IpIpLink:
+			route.IPIPMode = types.EncapAlways
+		case types.VXLANLink:
+			// the gateway is the tunnel address of the node, published with its vtep
+			vtep, ok := vteps[localRoute.Gw.String()]
+			if !ok {
+				continue
 			}
+			route.GwIP = vtep.NodeIP
+			route.VXLANMode = types.EncapAlways
+			route.VTEP = vtep
 		}
+		if n.viaLinkName(localNetworks, route) != linkName || !localRoute.Gw.Equal(n.nextHop(localNetworks, route)) {
+			klog.V(2).Infof("route [%s] via [%s] dev [%s] can not be told, left to the full sync", localRoute.Dst, localRoute.Gw, linkName)
+			continue
+		}
+		installed = append(installed, route)
 	}
-	return calicoRoutes
+	return installed, nil
+}
+
+func (n netlinkHandle) RouteMatch(localNetworks []types.LocalNetwork, localRoute *netlink.Route, route *types.Route) bool {
+	linkName := n.viaLinkName(localNetworks, route)
+	if len(linkName) == 0 || !n.owned(localRoute) ||
+		!equalIPNet(localRoute.Dst, route.DstNet) || !localRoute.Gw.Equal(n.nextHop(localNetworks, route)) {
+		return false
+	}
+	name, err := n.linkName(localRoute.LinkIndex)
+	if err != nil {
+		return false
+	}
+	return name == linkName
 }
 
 func (n netlinkHandle) RouteCheckAndDel(localNetworks []types.LocalNetwork, route *types.Route) error {
@@ -42,73 +283,278 @@ func (n netlinkHandle) RouteCheckAndDel(localNetworks []types.LocalNetwork, rout
 	return n.RouteDel(route)
 }
 
+// ensureAction how RouteEnsure installs a route
+type ensureAction int
+
+const (
+	// ensureNone the route is installed already
+	ensureNone ensureAction = iota
+	ensureAdd
+	// ensureReplace the managed routes to the dst are replaced in place
+	ensureReplace
+	// ensureConflict a route of others to the dst, never overwritten
+	ensureConflict
+)
+
+// planEnsure decide how the route is installed from a single lookup of the routes to its dst,
+// the unmarked routes are managed when adopted. Returns the managed routes to replace,
+// or the routes of others in conflict
+func (n netlinkHandle) planEnsure(localNetworks []types.LocalNetwork, route *types.Route) (ensureAction, []netlink.Route, error) {
+	current, err := n.routesTo(route.DstNet)
+	if err != nil {
+		klog.Errorf("get routes err: %v", err)
+		return ensureNone, nil, err
+	}
+	var previous, foreign []netlink.Route
+	for i := range current {
+		if n.managed(&current[i]) {
+			previous = append(previous, current[i])
+		} else {
+			foreign = append(foreign, current[i])
+		}
+	}
+	if linkName := n.viaLinkName(localNetworks, route); linkName != "" &&
+		n.routeExist(previous, route, linkName, n.nextHop(localNetworks, route)) {
+		return ensureNone, nil, nil
+	}
+	// a replace would overwrite the route of others
+	if len(foreign) > 0 {
+		return ensureConflict, foreign, nil
+	}
+	if len(previous) == 0 {
+		return ensureAdd, nil, nil
+	}
+	return ensureReplace, previous, nil
+}
+
+// conflictError the refusal to overwrite the routes of others to the dst
+func conflictError(route *types.Route, foreign []netlink.Route) error {
+	for i := range foreign {
+		if foreign[i].Protocol == unix.RTPROT_BOOT || foreign[i].Protocol == unix.RTPROT_STATIC {
+			return fmt.Errorf("route [%s] already exists without our protocol marker (proto %d), "+
+				"enable the adoption of unmarked routes (--adopt-unmarked-routes) to take it over", route.DstNet, foreign[i].Protocol)
+		}
+	}
+	return fmt.Errorf("route [%s] already exists and is installed by others (proto %d), it is never overwritten",
+		route.DstNet, foreign[0].Protocol)
+}
+
+// RouteEnsure add the route, or replace the managed routes to its dst in a single step:
+// the dst is never left without a route, and the previous route is restored when the replace fails
 func (n netlinkHandle) RouteEnsure(localNetworks []types.LocalNetwork, route *types.Route) error {
-	var err error
-	if n.RouteExist(localNetworks, route) {
-		return nil
+	action, previous, err := n.planEnsure(localNetworks, route)
+	if err != nil {
+		return err
 	}
-	if n.RouteConflict(localNetworks, route) {
-		err = n.RouteDel(route)
-		if err != nil {
+	if action == ensureConflict {
+		err = conflictError(route, previous)
+		metrics.ObserveRouteOperation("add", err)
+		return err
+	}
+	// the vtep is programmed before the route through it, and again only when it changed
+	if n.useVXLAN(localNetworks, route) && (action != ensureNone || !n.vtepProgrammed(route.VTEP)) {
+		if err = n.vtepEnsure(route.VTEP); err != nil {
 			return err
 		}
 	}
-	return n.RouteAdd(localNetworks, route)
+	switch action {
+	case ensureNone:
+		return nil
+	case ensureAdd:
+		err = n.RouteAdd(localNetworks, route)
+		metrics.ObserveRouteOperation("add", err)
+		return err
+	}
+	err = n.routeReplace(localNetworks, route, previous)
+	metrics.ObserveRouteOperation("replace", err)
+	return err
 }
 
-// RouteAdd TODO Compatible with other networks through tun tunnel
-func (n netlinkHandle) RouteAdd(localNetworks []types.LocalNetwork, dr *types.Route) error {
+// managedRoutesTo the managed routes to the dst
+func (n netlinkHandle) managedRoutesTo(dst *net.IPNet) ([]netlink.Route, error) {
+	routes, err := n.routesTo(dst)
+	if err != nil {
+		klog.Errorf("get routes err: %v", err)
+		return nil, err
+	}
+	var to []netlink.Route
+	for i := range routes {
+		if n.managed(&routes[i]) {
+			to = append(to, routes[i])
+		}
+	}
+	return to, nil
+}
+
+// netlinkRoute the kernel route of the desired route via the node, directly or through a tunnel device,
+// and the interface it goes out of
+func (n netlinkHandle) netlinkRoute(localNetworks []types.LocalNetwork, dr *types.Route) (*netlink.Route, string, error) {
 	r := &netlink.Route{
-		Dst: dr.DstNet,
-		Gw:  dr.GwIP,
+		Dst:      dr.DstNet,
+		Gw:       dr.GwIP,
+		Protocol: n.protocol,
+		Realm:    n.realm,
+		Table:    n.table,
 	}
-	if !gwContains(localNetworks, dr) {
-		return errors.New(dr.GwIP.String() + " is not included in the local network")
+	if n.useVXLAN(localNetworks, dr) {
+		r.Gw = dr.VTEP.TunnelIP
+		return r, types.VXLANLink, n.onlink(r, types.VXLANLink)
 	}
-	var err error
-	for _, network := range localNetworks {
-		for _, ip4 := range network.LocalIp4 {
-			if ip4.Net.Contains(dr.GwIP) {
-				err = n.Handle.RouteAdd(r)
-				if err != nil {
-					klog.Errorf("add route: [%s] err: %v", r.Dst.String(), err)
-					continue
-				}
-				klog.Infof("add route: [%s] success, with interface [%s]", r.Dst.String(), network.LinkName)
-				return nil
+	if n.useIPIP(localNetworks, dr) {
+		return r, types.IpIpLink, n.onlink(r, types.IpIpLink)
+	}
+	linkName := getViaLinkName(localNetworks, dr)
+	if linkName == "" {
+		return nil, "", errors.New(dr.GwIP.String() + " is not included in the local network")
+	}
+	// the interface is set rather than resolved by the kernel, the view holds the route as installed
+	index, err := n.linkIndex(linkName)
+	if err != nil {
+		return nil, "", fmt.Errorf("get device [%s] err: %v", linkName, err)
+	}
+	r.LinkIndex = index
+	return r, linkName, nil
+}
+
+// RouteAdd add the route via the node, directly or through the tunnel device
+func (n netlinkHandle) RouteAdd(localNetworks []types.LocalNetwork, dr *types.Route) error {
+	r, linkName, err := n.netlinkRoute(localNetworks, dr)
+	if err != nil {
+		return err
+	}
+	return n.routeAdded(r, linkName, n.Handle.RouteAdd(r))
+}
+
+// routeAdded finish the add of r, err the outcome of the request
+func (n netlinkHandle) routeAdded(r *netlink.Route, linkName string, err error) error {
+	if err != nil {
+		metrics.NetlinkErrors.WithLabelValues("route_add").Inc()
+		klog.Errorf("add route: [%s] err: %v", r.Dst.String(), err)
+		return fmt.Errorf("add route: %s err: %v", r.Dst.String(), err)
+	}
+	n.view.added(*r)
+	klog.Infof("add route: [%s] success, with interface [%s]", r.Dst.String(), linkName)
+	return nil
+}
+
+// routeReplace replace the previous managed routes to the dst by the route in place
+func (n netlinkHandle) routeReplace(localNetworks []types.LocalNetwork, dr *types.Route, previous []netlink.Route) error {
+	r, linkName, err := n.netlinkRoute(localNetworks, dr)
+	if err != nil {
+		return err
+	}
+	return n.routeReplaced(r, linkName, previous, n.Handle.RouteReplace(r))
+}
+
+// routeReplaced finish the replace of the previous routes by r, err the outcome of the request. The previous
+// routes are restored when it failed. A previous route with another metric or tos is not replaced by the kernel,
+// it is deleted once the route is installed
+func (n netlinkHandle) routeReplaced(r *netlink.Route, linkName string, previous []netlink.Route, err error) error {
+	if err != nil {
+		metrics.NetlinkErrors.WithLabelValues("route_replace").Inc()
+		klog.Errorf("replace route: [%s] err: %v", r.Dst.String(), err)
+		n.rollback(previous)
+		return fmt.Errorf("replace route: %s err: %v", r.Dst.String(), err)
+	}
+	n.view.added(*r)
+	klog.Infof("replace route: [%s] success, with interface [%s]", r.Dst.String(), linkName)
+	var errs []error
+	for i := range previous {
+		if sameRouteKey(&previous[i], r) {
+			continue
+		}
+		if err = n.Handle.RouteDel(&previous[i]); err != nil {
+			metrics.NetlinkErrors.WithLabelValues("route_del").Inc()
+			klog.Errorf("del replaced route: [%s] via [%s] err: %v", previous[i].Dst, previous[i].Gw, err)
+			errs = append(errs, err)
+			continue
+		}
+		n.view.deleted(previous[i])
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// rollback re-add the previous routes gone after a failed replace
+func (n netlinkHandle) rollback(previous []netlink.Route) {
+	current, err := n.managedRoutesTo(previous[0].Dst)
+	if err != nil {
+		return
+	}
+	for i := range previous {
+		found := false
+		for j := range current {
+			if sameRouteKey(&current[j], &previous[i]) && current[j].Gw.Equal(previous[i].Gw) {
+				found = true
+				break
 			}
 		}
+		if found {
+			continue
+		}
+		if err = n.Handle.RouteAdd(&previous[i]); err != nil {
+			metrics.NetlinkErrors.WithLabelValues("route_add").Inc()
+			klog.Errorf("restore route: [%s] via [%s] err: %v", previous[i].Dst, previous[i].Gw, err)
+			continue
+		}
+		n.view.added(previous[i])
+		klog.Infof("restore route: [%s] via [%s]", previous[i].Dst, previous[i].Gw)
 	}
-	return errors.New(fmt.Sprintf("add route: %s err: %v", r.Dst.String(), err))
+}
+
+// sameRouteKey whether the kernel identifies both routes as the same, a replace overwrites it
+func sameRouteKey(r1, r2 *netlink.Route) bool {
+	return equalIPNet(r1.Dst, r2.Dst) && kernelPriority(r1) == kernelPriority(r2) && r1.Tos == r2.Tos
+}
+
+// kernelPriority the metric of the route as the kernel reports it, an ipv6 route without one gets 1024
+func kernelPriority(r *netlink.Route) int {
+	if r.Priority == 0 && r.Dst != nil && r.Dst.IP.To4() == nil {
+		return ip6DefaultPriority
+	}
+	return r.Priority
 }
 
 func gwContains(localNetworks []types.LocalNetwork, dr *types.Route) bool {
 	for _, network := range localNetworks {
-		for _, ip4 := range network.LocalIp4 {
-			if ip4.Net.Contains(dr.GwIP) {
-				return true
-			}
+		if network.Contains(dr.GwIP) {
+			return true
 		}
 	}
 	return false
 }
 
+// RouteDel delete the managed routes to route.DstNet, the routes without our marker are kept
 func (n netlinkHandle) RouteDel(route *types.Route) error {
-	err := n.Handle.RouteDel(&netlink.Route{
-		Dst: route.DstNet,
-	})
+	routes, err := n.managedRoutesTo(route.DstNet)
 	if err != nil {
-		klog.Error("del route err: %v", err)
-	} else {
-		klog.Infof("del route: %+v", route.DstNet)
+		return err
 	}
-	return err
+	for i := range routes {
+		err = n.routeDeleted(&routes[i], n.Handle.RouteDel(&routes[i]))
+		metrics.ObserveRouteOperation("delete", err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeDeleted finish the delete of r, err the outcome of the request
+func (n netlinkHandle) routeDeleted(r *netlink.Route, err error) error {
+	if err != nil {
+		metrics.NetlinkErrors.WithLabelValues("route_del").Inc()
+		klog.Errorf("del route err: %v", err)
+		return err
+	}
+	n.view.deleted(*r)
+	klog.Infof("del route: %+v", r.Dst)
+	return nil
 }
 
 func (n netlinkHandle) RouteDelNet(net *net.IPNet) error {
-	routes, err := n.RouteList(nil, netlink.FAMILY_V4)
+	routes, err := n.managedRoutes(util.IPFamily(net.IP))
 	if err != nil {
-		klog.Error("get routes err: %v", err)
+		klog.Errorf("get routes err: %v", err)
 		return err
 	}
 	for _, r := range routes {
@@ -126,36 +572,133 @@ func (n netlinkHandle) RouteDelNet(net *net.IPNet) error {
 }
 
 func (n netlinkHandle) RouteExist(localNetworks []types.LocalNetwork, dr *types.Route) bool {
-	linkName := getViaLinkName(localNetworks, dr)
+	linkName := n.viaLinkName(localNetworks, dr)
 	if len(linkName) == 0 {
 		return false
 	}
-	routes, err := n.RouteList(nil, netlink.FAMILY_V4)
+	routes, err := n.managedRoutesTo(dr.DstNet)
 	if err != nil {
-		klog.Error("get routes err: %v", err)
 		return false
 	}
-	return n.routeExist(routes, dr, linkName)
+	return n.routeExist(routes, dr, linkName, n.nextHop(localNetworks, dr))
 }
 
 func (n netlinkHandle) RouteConflict(localNetworks []types.LocalNetwork, dr *types.Route) bool {
-	linkName := getViaLinkName(localNetworks, dr)
-	routes, err := n.RouteList(nil, netlink.FAMILY_V4)
+	linkName := n.viaLinkName(localNetworks, dr)
+	routes, err := n.managedRoutesTo(dr.DstNet)
 	if err != nil {
-		klog.Error("get routes err: %v", err)
 		return false
 	}
-	return n.routeConflict(routes, dr, linkName)
+	return n.routeConflict(routes, dr, linkName, n.nextHop(localNetworks, dr))
+}
+
+// dedicatedTable Whether the routes are installed into a table of our own, which needs ip rules
+func (n netlinkHandle) dedicatedTable() bool {
+	return n.table != unix.RT_TABLE_MAIN
+}
+
+// ownedRules list the ip rules pointing to our table and carrying our protocol marker,
+// the identical rules installed by others are left alone
+func (n netlinkHandle) ownedRules() ([]netlink.Rule, error) {
+	rules, err := n.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var owned []netlink.Rule
+	for _, rule := range rules {
+		if rule.Table == n.table && rule.Priority == n.rulePriority && rule.Dst != nil &&
+			rule.Protocol == uint8(n.protocol) {
+			owned = append(owned, rule)
+		}
+	}
+	return owned, nil
+}
+
+func (n netlinkHandle) RuleEnsure(pools []net.IPNet) error {
+	return n.ruleEnsure(pools, true)
 }
 
-func (n netlinkHandle) routeConflict(localRoutes []netlink.Route, r *types.Route, name string) bool {
+func (n netlinkHandle) RuleAddMissing(pools []net.IPNet) error {
+	return n.ruleEnsure(pools, false)
+}
+
+// ruleEnsure add the missing ip rules of the pools, and delete the other owned rules when prune
+func (n netlinkHandle) ruleEnsure(pools []net.IPNet, prune bool) error {
+	if !n.dedicatedTable() {
+		return nil
+	}
+	rules, err := n.ownedRules()
+	if err != nil {
+		klog.Errorf("get rules err: %v", err)
+		return err
+	}
+	var errs []error
+	for i := range rules {
+		if !prune || containsNet(pools, rules[i].Dst) {
+			continue
+		}
+		if err = n.RuleDel(&rules[i]); err != nil {
+			metrics.NetlinkErrors.WithLabelValues("rule_del").Inc()
+			klog.Errorf("del rule: [to %s lookup %d] err: %v", rules[i].Dst, n.table, err)
+			errs = append(errs, err)
+			continue
+		}
+		klog.Infof("del rule: [to %s lookup %d]", rules[i].Dst, n.table)
+	}
+	for i := range pools {
+		if containsRule(rules, &pools[i]) {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Dst = &pools[i]
+		rule.Table = n.table
+		rule.Priority = n.rulePriority
+		rule.Protocol = uint8(n.protocol)
+		if err = n.RuleAdd(rule); err != nil {
+			metrics.NetlinkErrors.WithLabelValues("rule_add").Inc()
+			klog.Errorf("add rule: [to %s lookup %d] err: %v", rule.Dst, n.table, err)
+			errs = append(errs, err)
+			continue
+		}
+		klog.Infof("add rule: [to %s lookup %d] success", rule.Dst, n.table)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (n netlinkHandle) RuleClean() error {
+	return n.RuleEnsure(nil)
+}
+
+func containsNet(nets []net.IPNet, n *net.IPNet) bool {
+	for i := range nets {
+		if equalIPNet(&nets[i], n) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRule(rules []netlink.Rule, n *net.IPNet) bool {
+	for i := range rules {
+		if equalIPNet(rules[i].Dst, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n netlinkHandle) routeConflict(localRoutes []netlink.Route, r *types.Route, name string, gw net.IP) bool {
 	for _, localRoute := range localRoutes {
 		if equalIPNet(localRoute.Dst, r.DstNet) {
-			link, err := n.LinkByIndex(localRoute.LinkIndex)
+			// an adopted route is rewritten with our marker
+			if !n.owned(&localRoute) {
+				return true
+			}
+			linkName, err := n.linkName(localRoute.LinkIndex)
 			if err != nil {
 				return true
 			}
-			if !localRoute.Gw.Equal(r.GwIP) || link.Attrs().Name != name {
+			if !localRoute.Gw.Equal(gw) || linkName != name {
 				return true
 			}
 		}
@@ -163,28 +706,46 @@ func (n netlinkHandle) routeConflict(localRoutes []netlink.Route, r *types.Route
 	return false
 }
 
-func (n netlinkHandle) routeExist(localRoutes []netlink.Route, r *types.Route, name string) bool {
+func (n netlinkHandle) routeExist(localRoutes []netlink.Route, r *types.Route, name string, gw net.IP) bool {
 	for _, localRoute := range localRoutes {
 		if equalIPNet(localRoute.Dst, r.DstNet) &&
-			localRoute.Gw.Equal(r.GwIP) {
-			link, err := n.LinkByIndex(localRoute.LinkIndex)
+			localRoute.Gw.Equal(gw) && n.owned(&localRoute) {
+			linkName, err := n.linkName(localRoute.LinkIndex)
 			if err != nil {
 				continue
 			}
-			if link.Attrs().Name == name {
-				klog.Infof("route [%s] already exist, with interface [%s]", r.DstNet, name)
+			if linkName == name {
+				klog.V(4).Infof("route [%s] already exist, with interface [%s]", r.DstNet, name)
 				return true
 			}
 		}
 	}
 	return false
 }
+
+// viaLinkName the interface the route goes out of, the tunnel device when the node is reached through it
+func (n netlinkHandle) viaLinkName(localNetworks []types.LocalNetwork, dr *types.Route) string {
+	if n.useVXLAN(localNetworks, dr) {
+		return types.VXLANLink
+	}
+	if n.useIPIP(localNetworks, dr) {
+		return types.IpIpLink
+	}
+	return getViaLinkName(localNetworks, dr)
+}
+
+// nextHop the gateway of the route, the vxlan tunnel address of the node when the node is reached through vxlan
+func (n netlinkHandle) nextHop(localNetworks []types.LocalNetwork, dr *types.Route) net.IP {
+	if n.useVXLAN(localNetworks, dr) {
+		return dr.VTEP.TunnelIP
+	}
+	return dr.GwIP
+}
+
 func getViaLinkName(localNetworks []types.LocalNetwork, dr *types.Route) string {
 	for _, network := range localNetworks {
-		for _, ip4 := range network.LocalIp4 {
-			if ip4.Net.Contains(dr.GwIP) {
-				return network.LinkName
-			}
+		if network.Contains(dr.GwIP) {
+			return network.LinkName
 		}
 	}
 	return ""
@@ -0,0 +1,63 @@
+package route
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// testNetns6 the namespace of testNetns, eth0 also in fd09::/64
+func testNetns6(t *testing.T) []types.LocalNetwork {
+	t.Helper()
+	local := testNetns(t)
+	link, err := netlink.LinkByName("eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := util.ParseNet("fd09::/64")
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: util.NthIP(nodes, 1), Mask: nodes.Mask}, Flags: unix.IFA_F_NODAD}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		t.Skipf("add ipv6 address: %v", err)
+	}
+	local[0].LocalIp6 = []types.IP6{{Net: nodes, IP: util.NthIP(nodes, 1)}}
+	return local
+}
+
+// kernelRoutes6 the gateways of the ipv6 routes of the main table by dst
+func kernelRoutes6(t *testing.T) map[string][]string {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gws := map[string][]string{}
+	for _, r := range routes {
+		if r.Dst != nil && r.Gw != nil {
+			gws[r.Dst.String()] = append(gws[r.Dst.String()], r.Gw.String())
+		}
+	}
+	return gws
+}
+
+// TestRouteEnsureReplaceIPv6 the kernel replaces an ipv6 route in place, nothing is left to delete
+func TestRouteEnsureReplaceIPv6(t *testing.T) {
+	local := testNetns6(t)
+	opts := Options{Protocol: types.DefaultRouteProtocol}
+	n := newNetLinkHandle(opts, newRouteView(opts.table()))
+
+	route := &types.Route{DstNet: util.ParseNet("fd00::/122"), GwIP: net.ParseIP("fd09::2")}
+	if err := n.RouteEnsure(local, route); err != nil {
+		t.Fatal(err)
+	}
+	route = &types.Route{DstNet: util.ParseNet("fd00::/122"), GwIP: net.ParseIP("fd09::3")}
+	if err := n.RouteEnsure(local, route); err != nil {
+		t.Errorf("replace ipv6 route: %v", err)
+	}
+	if gws := kernelRoutes6(t)["fd00::/122"]; len(gws) != 1 || gws[0] != "fd09::3" {
+		t.Errorf("routes to fd00::/122 via %v, want fd09::3", gws)
+	}
+}
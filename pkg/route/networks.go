@@ -0,0 +1,138 @@
+package route
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// networkSettle coalesce the burst of link/address updates, e.g. a bond coming up
+const networkSettle = time.Second
+
+// LocalNetworks the current view of the directly connected networks
+func (r *Router) LocalNetworks() []types.LocalNetwork {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]types.LocalNetwork(nil), r.localNetworks...)
+}
+
+// WatchLocalNetworks subscribe to the link and address updates, refresh the local networks
+// and re-reconcile all the desired routes when the connected subnets changed, blocks until ctx is done
+func (r *Router) WatchLocalNetworks(ctx context.Context) error {
+	for {
+		done := make(chan struct{})
+		linkCh := make(chan netlink.LinkUpdate, 128)
+		addrCh := make(chan netlink.AddrUpdate, 128)
+		errorCallback := func(err error) {
+			klog.Errorf("link/address subscription err: %v", err)
+		}
+		err := netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{ErrorCallback: errorCallback})
+		if err == nil {
+			err = netlink.AddrSubscribeWithOptions(addrCh, done, netlink.AddrSubscribeOptions{ErrorCallback: errorCallback})
+		}
+		if err != nil {
+			klog.Errorf("subscribe links/addresses err: %v", err)
+		} else {
+			klog.Info("watching local link and address updates")
+			r.view.trackLinks(true)
+			// an update may have been missed while (re)subscribing
+			r.RefreshLocalNetworks()
+			r.consumeNetworkUpdates(ctx, linkCh, addrCh)
+		}
+		r.view.trackLinks(false)
+		close(done)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (r *Router) consumeNetworkUpdates(ctx context.Context, linkCh <-chan netlink.LinkUpdate, addrCh <-chan netlink.AddrUpdate) {
+	settle := time.NewTimer(networkSettle)
+	settle.Stop()
+	defer settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-linkCh:
+			if !ok {
+				klog.Warning("link subscription closed")
+				return
+			}
+			r.view.linkUpdate(&update)
+			settle.Reset(networkSettle)
+		case _, ok := <-addrCh:
+			if !ok {
+				klog.Warning("address subscription closed")
+				return
+			}
+			settle.Reset(networkSettle)
+		case <-settle.C:
+			r.RefreshLocalNetworks()
+		}
+	}
+}
+
+// RefreshLocalNetworks reload the local networks, the desired routes are re-reconciled
+// when the set of directly connected subnets changed
+func (r *Router) RefreshLocalNetworks() {
+	localNetworks, err := util.LocalNetworks()
+	if err != nil {
+		klog.Errorf("refresh local networks err: %v, keep the previous ones", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if equalSubnets(r.localNetworks, localNetworks) {
+		r.localNetworks = localNetworks
+		return
+	}
+	klog.Infof("local networks changed: %v -> %v", subnets(r.localNetworks), subnets(localNetworks))
+	r.localNetworks = localNetworks
+	r.ensureDesired()
+}
+
+// ensureDesired re-reconcile all the desired routes, r.mu must be held
+func (r *Router) ensureDesired() {
+	for key, route := range r.desired {
+		if err := r.netlinkHandle.RouteEnsure(r.localNetworks, route); err != nil {
+			klog.Errorf("ensure route [%s] err: %v", key, err)
+		}
+	}
+}
+
+// subnets the sorted "link/cidr" of the directly connected subnets
+func subnets(localNetworks []types.LocalNetwork) []string {
+	var s []string
+	for _, network := range localNetworks {
+		for _, ip4 := range network.LocalIp4 {
+			s = append(s, network.LinkName+"/"+ip4.Net.String())
+		}
+		for _, ip6 := range network.LocalIp6 {
+			s = append(s, network.LinkName+"/"+ip6.Net.String())
+		}
+	}
+	sort.Strings(s)
+	return s
+}
+
+func equalSubnets(a, b []types.LocalNetwork) bool {
+	sa, sb := subnets(a), subnets(b)
+	if len(sa) != len(sb) {
+		return false
+	}
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+	return true
+}
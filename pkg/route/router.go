@@ -1,13 +1,17 @@
 package route
 
 import (
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/vishvananda/netlink"
-	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
 	"github.com/yzxiu/calico-route-sync/pkg/types"
 	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
 )
 
 type Interface interface {
@@ -16,70 +20,287 @@ type Interface interface {
 type Router struct {
 	localNetworks []types.LocalNetwork
 	netlinkHandle NetLinkHandle
+	opts          Options
 	mu            sync.Mutex
+	// desired the routes we want in the kernel, keyed by dst cidr
+	desired map[string]*types.Route
+	drift   *driftWatcher
+	// frozen the reason the route deletes are frozen, empty when they are allowed
+	frozen  string
+	breaker *deleteBreaker
+	// removed the deleted, disabled or filtered out pools whose routes were kept by the frozen deletes
+	// or the delete breaker, the full sync deletes them
+	removed map[string]*net.IPNet
+	// view the in-memory routes and links read by the netlink handle
+	view *routeView
 }
 
-func NewRouter(localNetworks []types.LocalNetwork) (*Router, error) {
+// Options how the routes are marked in the kernel
+type Options struct {
+	// Protocol rtnetlink protocol set on every route we install,
+	// only the routes carrying it are considered ours
+	Protocol int
+	// Realm optional route realm set on every route we install, 0 means unset
+	Realm int
+	// AdoptUnmarked take over the pre-existing routes without marker (proto boot/static)
+	AdoptUnmarked bool
+	// Table routing table holding the routes, 0 means the main table.
+	// A dedicated table is looked up through an ip rule per IPPool cidr
+	Table int
+	// RulePriority priority of the ip rules of a dedicated table
+	RulePriority int
+	// IPIP route the blocks of the pools with IPIPMode set through the ipip tunnel device
+	IPIP bool
+	// IPIPMTU mtu of the ipip tunnel device
+	IPIPMTU int
+	// VXLAN route the blocks of the pools with VXLANMode set through the vxlan device,
+	// joining Calico's vxlan overlay
+	VXLAN     bool
+	VXLANMTU  int
+	VXLANVNI  int
+	VXLANPort int
+	// DriftDebounce how long a changed route must stay quiet before it is repaired
+	DriftDebounce time.Duration
+	// DryRun log and count the route, rule and tunnel changes, never apply them
+	DryRun bool
+	// StateFile where the desired routes of the last consistent full sync are persisted, empty disables it
+	StateFile string
+	// MaxDeleteFraction MaxDeleteCount the most managed routes a full sync deletes at once without
+	// confirmation, as a fraction of the managed routes and as a count, 0 means no limit
+	MaxDeleteFraction float64
+	MaxDeleteCount    int
+}
+
+// table the effective routing table
+func (o Options) table() int {
+	if o.Table == 0 {
+		return unix.RT_TABLE_MAIN
+	}
+	return o.Table
+}
+
+// Validate check the options are usable
+func (o Options) Validate() error {
+	if o.Protocol <= unix.RTPROT_STATIC || o.Protocol > 255 {
+		return fmt.Errorf("invalid route protocol %d, must be in (%d, 255]", o.Protocol, unix.RTPROT_STATIC)
+	}
+	if o.Realm < 0 || o.Realm > 255 {
+		return fmt.Errorf("invalid route realm %d, must be in [0, 255]", o.Realm)
+	}
+	if o.Table < 0 || o.Table == unix.RT_TABLE_LOCAL || o.Table == unix.RT_TABLE_DEFAULT {
+		return fmt.Errorf("invalid route table %d", o.Table)
+	}
+	if o.RulePriority <= 0 || o.RulePriority >= 32766 {
+		return fmt.Errorf("invalid rule priority %d, must be in (0, 32766)", o.RulePriority)
+	}
+	if o.MaxDeleteFraction < 0 || o.MaxDeleteFraction > 1 || o.MaxDeleteCount < 0 {
+		return fmt.Errorf("invalid max delete fraction %v or count %d", o.MaxDeleteFraction, o.MaxDeleteCount)
+	}
+	if o.DriftDebounce <= 0 {
+		return fmt.Errorf("invalid drift debounce %s", o.DriftDebounce)
+	}
+	if o.IPIP && (o.IPIPMTU < 576 || o.IPIPMTU > 65515) {
+		return fmt.Errorf("invalid ipip mtu %d", o.IPIPMTU)
+	}
+	if o.VXLAN && (o.VXLANMTU < 576 || o.VXLANMTU > 65485) {
+		return fmt.Errorf("invalid vxlan mtu %d", o.VXLANMTU)
+	}
+	if o.VXLAN && (o.VXLANVNI <= 0 || o.VXLANVNI >= 1<<24 || o.VXLANPort <= 0 || o.VXLANPort > 65535) {
+		return fmt.Errorf("invalid vxlan vni %d or port %d", o.VXLANVNI, o.VXLANPort)
+	}
+	return nil
+}
+
+func NewRouter(localNetworks []types.LocalNetwork, opts Options) (*Router, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	view := newRouteView(opts.table())
+	netlinkHandle := newNetLinkHandle(opts, view)
+	var handle NetLinkHandle = netlinkHandle
+	if opts.DryRun {
+		handle = newDryRunHandle(netlinkHandle)
+	}
 	router := &Router{
 		localNetworks: localNetworks,
-		netlinkHandle: NewNetLinkHandle(),
+		netlinkHandle: handle,
+		opts:          opts,
+		desired:       map[string]*types.Route{},
+		breaker:       &deleteBreaker{maxFraction: opts.MaxDeleteFraction, maxCount: opts.MaxDeleteCount},
+		removed:       map[string]*net.IPNet{},
+		view:          view,
 	}
+	router.drift = newDriftWatcher(router, opts.DriftDebounce)
 	return router, nil
 }
 
 // UpdateRoute update route
-func (r *Router) UpdateRoute(affinity *calico.BlockAffinity, nodeIP net.IP) error {
-
-	_, podNet, err := net.ParseCIDR(affinity.Spec.CIDR)
-	if err != nil {
-		return err
+func (r *Router) UpdateRoute(route *types.Route) error {
+	if route.GwIP == nil || util.IPFamily(route.GwIP) != util.IPFamily(route.DstNet.IP) {
+		return fmt.Errorf("node ip [%s] does not match the family of block [%s]", route.GwIP, route.DstNet)
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.desiredChanged()
+	r.desired[route.DstNet.String()] = route
+	return r.netlinkHandle.RouteEnsure(r.localNetworks, route)
+}
+
+// DeleteRoute del route
+func (r *Router) DeleteRoute(dst *net.IPNet) error {
 	route := &types.Route{
-		DstNet: podNet,
-		GwIP:   nodeIP,
+		DstNet: dst,
 	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.netlinkHandle.RouteEnsure(r.localNetworks, route)
+	defer r.desiredChanged()
+	delete(r.desired, dst.String())
+	if r.keep(dst) {
+		return nil
+	}
+	return r.netlinkHandle.RouteDel(route)
 }
 
-// DeleteRoute del route
-func (r *Router) DeleteRoute(affinity *calico.BlockAffinity) error {
+// SyncHostRoutes make the host routes inside the block exactly routes, the route of the block itself is left alone
+func (r *Router) SyncHostRoutes(block *net.IPNet, routes []*types.Route) error {
+	wanted := make(map[string]*types.Route, len(routes))
+	for _, route := range routes {
+		if route.GwIP == nil || util.IPFamily(route.GwIP) != util.IPFamily(route.DstNet.IP) {
+			return fmt.Errorf("node ip [%s] does not match the family of address [%s]", route.GwIP, route.DstNet)
+		}
+		wanted[route.DstNet.String()] = route
+	}
 
-	_, podNet, err := net.ParseCIDR(affinity.Spec.CIDR)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.desiredChanged()
+	for key, route := range r.desired {
+		if _, ok := wanted[key]; !ok && hostRouteOf(block, route.DstNet) {
+			delete(r.desired, key)
+		}
+	}
+	installed, err := r.netlinkHandle.ManagedRoutes([]net.IPNet{*block})
 	if err != nil {
 		return err
 	}
+	var errs []error
+	for _, route := range installed {
+		if _, ok := wanted[route.Dst.String()]; ok || !hostRouteOf(block, route.Dst) || r.keep(route.Dst) {
+			continue
+		}
+		if err := r.netlinkHandle.RouteDel(&types.Route{DstNet: route.Dst}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for key, route := range wanted {
+		r.desired[key] = route
+		if err := r.netlinkHandle.RouteEnsure(r.localNetworks, route); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
 
-	route := &types.Route{
-		DstNet: podNet,
+// hostRouteOf whether dst is more specific than the block and inside it
+func hostRouteOf(block, dst *net.IPNet) bool {
+	blockOnes, _ := block.Mask.Size()
+	ones, _ := dst.Mask.Size()
+	return ones > blockOnes && util.ContainsCIDR(block, dst)
+}
+
+// desiredChanged publish the size of the desired set, r.mu must be held
+func (r *Router) desiredChanged() {
+	metrics.DesiredRoutes.Set(float64(len(r.desired)))
+}
+
+// EnsureTunnels create and bring up the enabled tunnel devices
+func (r *Router) EnsureTunnels() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.netlinkHandle.TunnelEnsure()
+}
+
+// DeletePoolRoutes del all the routes of a deleted, disabled or filtered out pool. Too many routes for
+// the delete breaker, or the deletes frozen, they are left to the full sync and its breaker
+func (r *Router) DeletePoolRoutes(pool *net.IPNet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.desiredChanged()
+	for key, route := range r.desired {
+		if util.ContainsCIDR(pool, route.DstNet) {
+			delete(r.desired, key)
+		}
 	}
+	if r.keep(pool) {
+		r.removed[pool.String()] = pool
+		return nil
+	}
+	stale, err := r.netlinkHandle.ManagedRoutes([]net.IPNet{*pool})
+	if err != nil {
+		return err
+	}
+	others, err := r.netlinkHandle.OrphanRoutes([]net.IPNet{*pool})
+	if err != nil {
+		return err
+	}
+	if r.breaker.exceeded(len(stale), len(stale)+len(others)) {
+		klog.Warningf("delete breaker: %d of %d managed routes in pool [%s], left to the full sync",
+			len(stale), len(stale)+len(others), pool)
+		r.removed[pool.String()] = pool
+		return nil
+	}
+	delete(r.removed, pool.String())
+	return r.netlinkHandle.RouteDelNet(pool)
+}
 
+// EnsureRules add the missing ip rules of the pools and delete the stale ones, left alone while the deletes are frozen
+func (r *Router) EnsureRules(pools []net.IPNet) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.netlinkHandle.RouteDel(route)
+	if r.frozen != "" {
+		return nil
+	}
+	return r.netlinkHandle.RuleEnsure(pools)
 }
 
-func (r *Router) CheckRouters(pools []net.IPNet, blocks []net.IPNet) {
+// AdoptRoutes take over the managed routes inside the pools left in place by a previous run: they are
+// the desired routes, repaired on drift, until the first full sync reconciles them against the cluster.
+// The adopted unmarked routes are rewritten with our marker
+func (r *Router) AdoptRoutes(pools []net.IPNet) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	calicoRoutes := r.netlinkHandle.CalicoRoutes(pools)
-	for _, route := range calicoRoutes {
-		if !contains(blocks, route) {
-			ro := &types.Route{
-				DstNet: route.Dst,
-			}
-			_ = r.netlinkHandle.RouteDel(ro)
+	defer r.desiredChanged()
+	routes, err := r.netlinkHandle.InstalledRoutes(r.localNetworks, pools)
+	if err != nil {
+		return 0, err
+	}
+	var adopted int
+	var errs []error
+	for _, route := range routes {
+		key := route.DstNet.String()
+		// restored from the state file
+		if _, ok := r.desired[key]; ok {
+			continue
+		}
+		r.desired[key] = route
+		if err := r.netlinkHandle.RouteEnsure(r.localNetworks, route); err != nil {
+			errs = append(errs, err)
+			continue
 		}
+		klog.V(2).Infof("adopt route: [%s] via [%s]", route.DstNet, route.GwIP)
+		adopted++
 	}
+	metrics.InstalledRoutes.Set(float64(len(routes)))
+	return adopted, utilerrors.NewAggregate(errs)
 }
 
 // CleanRoutes del cidr route
 func (r *Router) CleanRoutes(pools []net.IPNet) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	defer r.desiredChanged()
 	calicoRoutes := r.netlinkHandle.CalicoRoutes(pools)
 	for _, route := range calicoRoutes {
 		ro := &types.Route{
@@ -87,13 +308,7 @@ func (r *Router) CleanRoutes(pools []net.IPNet) {
 		}
 		_ = r.netlinkHandle.RouteDel(ro)
 	}
-}
-
-func contains(blocks []net.IPNet, route netlink.Route) bool {
-	for _, block := range blocks {
-		if util.ContainsCIDR(&block, route.Dst) {
-			return true
-		}
-	}
-	return false
+	r.desired = map[string]*types.Route{}
+	_ = r.netlinkHandle.VTEPSync(nil)
+	_ = r.netlinkHandle.RuleClean()
 }
@@ -0,0 +1,212 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// state the desired routes of the last full sync made with a consistent view of the cluster
+type state struct {
+	Pools  []string     `json:"pools"`
+	Routes []stateRoute `json:"routes"`
+}
+
+type stateRoute struct {
+	Dst       string     `json:"dst"`
+	Gw        string     `json:"gw"`
+	IPIPMode  string     `json:"ipipMode,omitempty"`
+	VXLANMode string     `json:"vxlanMode,omitempty"`
+	VTEP      *stateVTEP `json:"vtep,omitempty"`
+}
+
+type stateVTEP struct {
+	TunnelIP string `json:"tunnelIP"`
+	MAC      string `json:"mac"`
+	NodeIP   string `json:"nodeIP"`
+}
+
+func newState(pools []net.IPNet, routes map[string]*types.Route) *state {
+	s := &state{Pools: []string{}, Routes: make([]stateRoute, 0, len(routes))}
+	for i := range pools {
+		s.Pools = append(s.Pools, pools[i].String())
+	}
+	for _, route := range routes {
+		sr := stateRoute{
+			Dst:       route.DstNet.String(),
+			Gw:        route.GwIP.String(),
+			IPIPMode:  route.IPIPMode,
+			VXLANMode: route.VXLANMode,
+		}
+		if route.VTEP != nil {
+			sr.VTEP = &stateVTEP{
+				TunnelIP: route.VTEP.TunnelIP.String(),
+				MAC:      route.VTEP.MAC.String(),
+				NodeIP:   route.VTEP.NodeIP.String(),
+			}
+		}
+		s.Routes = append(s.Routes, sr)
+	}
+	return s
+}
+
+// decode the pools and routes of the state, an invalid entry fails the whole state
+func (s *state) decode() ([]net.IPNet, []*types.Route, error) {
+	pools, err := parseStateCIDRs(s.Pools)
+	if err != nil {
+		return nil, nil, err
+	}
+	routes := make([]*types.Route, 0, len(s.Routes))
+	for _, sr := range s.Routes {
+		route := &types.Route{
+			DstNet:    util.ParseNet(sr.Dst),
+			GwIP:      net.ParseIP(sr.Gw),
+			IPIPMode:  sr.IPIPMode,
+			VXLANMode: sr.VXLANMode,
+		}
+		if route.DstNet == nil || route.GwIP == nil {
+			return nil, nil, fmt.Errorf("invalid route [%s] via [%s]", sr.Dst, sr.Gw)
+		}
+		if sr.VTEP != nil {
+			mac, err := net.ParseMAC(sr.VTEP.MAC)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid vtep mac of route [%s]: %v", sr.Dst, err)
+			}
+			route.VTEP = &types.VTEP{
+				TunnelIP: net.ParseIP(sr.VTEP.TunnelIP),
+				MAC:      mac,
+				NodeIP:   net.ParseIP(sr.VTEP.NodeIP),
+			}
+			if route.VTEP.TunnelIP == nil || route.VTEP.NodeIP == nil {
+				return nil, nil, fmt.Errorf("invalid vtep of route [%s]", sr.Dst)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return pools, routes, nil
+}
+
+func parseStateCIDRs(cidrs []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		n := util.ParseNet(cidr)
+		if n == nil {
+			return nil, fmt.Errorf("invalid pool cidr %q", cidr)
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
+
+// saveState write the state file atomically, r.mu must be held
+func (r *Router) saveState(pools []net.IPNet) error {
+	data, err := json.Marshal(newState(pools, r.desired))
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(r.opts.StateFile)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.opts.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.opts.StateFile)
+}
+
+// RestoreState install the routes of the state file, when the cluster can not be reached at boot.
+// The restored routes are the desired routes until the next full sync
+func (r *Router) RestoreState() (int, error) {
+	if r.opts.StateFile == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(r.opts.StateFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	s := &state{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return 0, fmt.Errorf("parse state file %s: %v", r.opts.StateFile, err)
+	}
+	pools, routes, err := s.decode()
+	if err != nil {
+		return 0, fmt.Errorf("state file %s: %v", r.opts.StateFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.desiredChanged()
+	ensureRules := r.netlinkHandle.RuleEnsure
+	if r.frozen != "" {
+		// the rules of the pools deleted since the state was saved are deleted by the first full sync
+		ensureRules = r.netlinkHandle.RuleAddMissing
+	}
+	if err = ensureRules(pools); err != nil {
+		klog.Errorf("ensure rules err: %v", err)
+	}
+	var restored int
+	for _, route := range routes {
+		r.desired[route.DstNet.String()] = route
+		if err := r.netlinkHandle.RouteEnsure(r.localNetworks, route); err != nil {
+			klog.Errorf("restore route [%s] err: %v", route.DstNet, err)
+			continue
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// Freeze never delete a route while the view of the cluster is not consistent,
+// the desired routes are still added and replaced
+func (r *Router) Freeze(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen == "" {
+		klog.Warningf("freeze the route deletes: %s", reason)
+	}
+	r.frozen = reason
+	metrics.DeletesFrozen.Set(1)
+}
+
+// Thaw allow the route deletes again, once the view of the cluster is consistent
+func (r *Router) Thaw() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen != "" {
+		klog.Infof("thaw the route deletes, frozen since: %s", r.frozen)
+	}
+	r.frozen = ""
+	metrics.DeletesFrozen.Set(0)
+}
+
+// keep whether the deletes are frozen, logging the route kept, r.mu must be held
+func (r *Router) keep(dst *net.IPNet) bool {
+	if r.frozen == "" {
+		return false
+	}
+	klog.Infof("route deletes frozen (%s), keep route [%s]", r.frozen, dst)
+	return true
+}
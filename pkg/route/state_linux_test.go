@@ -0,0 +1,141 @@
+package route
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+)
+
+// testStateFile write a state file of the pools and routes
+func testStateFile(t *testing.T, pools []net.IPNet, routes ...*types.Route) string {
+	t.Helper()
+	desired := map[string]*types.Route{}
+	for _, route := range routes {
+		desired[route.DstNet.String()] = route
+	}
+	data, err := json.Marshal(newState(pools, desired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ownedRuleDsts the dsts of the rules looking up the table
+func ownedRuleDsts(t *testing.T, table int) map[string]bool {
+	t.Helper()
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Table == table && rule.Dst != nil {
+			dsts[rule.Dst.String()] = true
+		}
+	}
+	return dsts
+}
+
+// TestRestoreState the routes and rules of the state file are restored, the rules of the other pools
+// are only deleted once the deletes are thawed
+func TestRestoreState(t *testing.T) {
+	local := testNetns(t)
+	pools := []net.IPNet{*util.ParseNet("10.64.0.0/16")}
+	route := &types.Route{DstNet: util.ParseNet("10.64.0.0/26"), GwIP: net.ParseIP("10.9.0.2")}
+	opts := Options{
+		Table:         100,
+		Protocol:      types.DefaultRouteProtocol,
+		RulePriority:  types.DefaultRulePriority,
+		DriftDebounce: 1,
+		StateFile:     testStateFile(t, pools, route),
+	}
+	r, err := NewRouter(local, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rule of a pool deleted since the state was saved, or of a pool the state misses
+	if err = r.netlinkHandle.RuleEnsure([]net.IPNet{*util.ParseNet("10.70.0.0/16")}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Freeze("no full sync yet")
+	restored, err := r.RestoreState()
+	if err != nil || restored != 1 {
+		t.Fatalf("RestoreState = %d, %v, want 1 route", restored, err)
+	}
+	if rules := ownedRuleDsts(t, 100); !rules["10.64.0.0/16"] || !rules["10.70.0.0/16"] {
+		t.Errorf("rules %v while frozen, want both pools", rules)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Dst.String() != "10.64.0.0/26" || !routes[0].Gw.Equal(route.GwIP) {
+		t.Errorf("restored routes %v", routes)
+	}
+	if r.desired["10.64.0.0/26"] == nil {
+		t.Errorf("the restored route is not desired")
+	}
+
+	r.Thaw()
+	if _, err = r.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if rules := ownedRuleDsts(t, 100); !rules["10.64.0.0/16"] || rules["10.70.0.0/16"] {
+		t.Errorf("rules %v once thawed, want the state pools only", rules)
+	}
+}
+
+// TestRestoreStateInvalid a missing state file restores nothing, an invalid one fails
+func TestRestoreStateInvalid(t *testing.T) {
+	local := testNetns(t)
+	opts := Options{Protocol: types.DefaultRouteProtocol, RulePriority: types.DefaultRulePriority, DriftDebounce: 1}
+	opts.StateFile = filepath.Join(t.TempDir(), "missing.json")
+	r, err := NewRouter(local, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := r.RestoreState(); err != nil || restored != 0 {
+		t.Errorf("RestoreState of a missing file = %d, %v", restored, err)
+	}
+	for _, data := range []string{`{"pools": [`, `{"pools": ["10.64.0.0/16"], "routes": [{"dst": "10.64.0.0/26"}]}`} {
+		if err = os.WriteFile(opts.StateFile, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.RestoreState(); err == nil {
+			t.Errorf("RestoreState of %s succeeded", data)
+		}
+	}
+	if len(r.desired) != 0 || len(kernelRoutes(t)) != 0 {
+		t.Errorf("an invalid state file restored %v", r.desired)
+	}
+}
+
+// TestSyncDryRunState a dry run never writes the state file
+func TestSyncDryRunState(t *testing.T) {
+	local := testNetns(t)
+	opts := Options{Protocol: types.DefaultRouteProtocol, RulePriority: types.DefaultRulePriority, DriftDebounce: 1, DryRun: true}
+	opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+	r, err := NewRouter(local, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := []net.IPNet{*util.ParseNet("10.64.0.0/16")}
+	desired := []*types.Route{{DstNet: util.ParseNet("10.64.0.0/26"), GwIP: net.ParseIP("10.9.0.2")}}
+	if _, err = r.Sync(pools, pools, desired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(opts.StateFile); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the state file: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package route
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("66:00:0a:09:00:02")
+	desired := map[string]*types.Route{
+		"10.64.0.0/26": {DstNet: util.ParseNet("10.64.0.0/26"), GwIP: net.ParseIP("10.9.0.2"), IPIPMode: "Always"},
+		"10.64.0.64/26": {
+			DstNet:    util.ParseNet("10.64.0.64/26"),
+			GwIP:      net.ParseIP("10.9.0.3"),
+			VXLANMode: "Always",
+			VTEP:      &types.VTEP{TunnelIP: net.ParseIP("10.64.0.65"), MAC: mac, NodeIP: net.ParseIP("10.9.0.3")},
+		},
+		"fd00::/122": {DstNet: util.ParseNet("fd00::/122"), GwIP: net.ParseIP("fd10::2")},
+	}
+	data, err := json.Marshal(newState([]net.IPNet{*util.ParseNet("10.64.0.0/16"), *util.ParseNet("fd00::/64")}, desired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{}
+	if err = json.Unmarshal(data, s); err != nil {
+		t.Fatal(err)
+	}
+	pools, routes, err := s.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools[0].String() != "10.64.0.0/16" || pools[1].String() != "fd00::/64" {
+		t.Errorf("decoded pools %v", pools)
+	}
+	if len(routes) != len(desired) {
+		t.Fatalf("decoded %d routes, want %d", len(routes), len(desired))
+	}
+	for _, route := range routes {
+		want := desired[route.DstNet.String()]
+		if want == nil || !route.GwIP.Equal(want.GwIP) || route.IPIPMode != want.IPIPMode || route.VXLANMode != want.VXLANMode {
+			t.Errorf("decoded route %+v, want %+v", route, want)
+			continue
+		}
+		if (route.VTEP == nil) != (want.VTEP == nil) {
+			t.Errorf("decoded vtep of [%s] %+v, want %+v", route.DstNet, route.VTEP, want.VTEP)
+			continue
+		}
+		if route.VTEP != nil && (!route.VTEP.TunnelIP.Equal(want.VTEP.TunnelIP) ||
+			route.VTEP.MAC.String() != want.VTEP.MAC.String() || !route.VTEP.NodeIP.Equal(want.VTEP.NodeIP)) {
+			t.Errorf("decoded vtep of [%s] %+v, want %+v", route.DstNet, route.VTEP, want.VTEP)
+		}
+	}
+}
+
+func TestStateDecodeInvalid(t *testing.T) {
+	vtep := func(tunnelIP, mac, nodeIP string) *stateVTEP {
+		return &stateVTEP{TunnelIP: tunnelIP, MAC: mac, NodeIP: nodeIP}
+	}
+	tests := []struct {
+		name  string
+		state state
+		// want a part of the error
+		want string
+	}{
+		{"pool", state{Pools: []string{"10.64.0.0/16", "10.65.0.0"}}, "invalid pool cidr"},
+		{"dst", state{Routes: []stateRoute{{Dst: "10.64.0.0/33", Gw: "10.9.0.2"}}}, "invalid route"},
+		{"gw", state{Routes: []stateRoute{{Dst: "10.64.0.0/26", Gw: "node-a"}}}, "invalid route"},
+		{"vtep mac", state{Routes: []stateRoute{{Dst: "10.64.0.0/26", Gw: "10.9.0.2",
+			VTEP: vtep("10.64.0.1", "66:00", "10.9.0.2")}}}, "invalid vtep mac"},
+		{"vtep ip", state{Routes: []stateRoute{{Dst: "10.64.0.0/26", Gw: "10.9.0.2",
+			VTEP: vtep("10.64.0.1", "66:00:0a:09:00:02", "")}}}, "invalid vtep"},
+	}
+	for _, tt := range tests {
+		_, _, err := tt.state.decode()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: decode err: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// SyncResult summary of a full sync
+type SyncResult struct {
+	Desired   int
+	Unchanged int
+	Added     int
+	Replaced  int
+	Deleted   int
+	Failed    int
+	Duration  time.Duration
+	// Kept the stale routes not deleted while the deletes are frozen
+	Kept int
+	// Blocked the stale routes not deleted by the tripped delete breaker
+	Blocked int
+	// DryRun the changes were only planned
+	DryRun bool
+}
+
+func (s SyncResult) String() string {
+	summary := fmt.Sprintf("desired=%d unchanged=%d added=%d replaced=%d deleted=%d failed=%d duration=%s",
+		s.Desired, s.Unchanged, s.Added, s.Replaced, s.Deleted, s.Failed, s.Duration)
+	if s.Kept > 0 {
+		summary += fmt.Sprintf(" kept=%d", s.Kept)
+	}
+	if s.Blocked > 0 {
+		summary += fmt.Sprintf(" blocked=%d", s.Blocked)
+	}
+	if s.DryRun {
+		summary += " dry-run=true"
+	}
+	return summary
+}
+
+// syncBatch the route changes of a full sync applied under a single hold of r.mu, their route messages
+// are sent in batched netlink writes. The reconciles and drift repairs go on between two batches
+const syncBatch = 256
+
+// syncChange a route change planned by a full sync
+type syncChange struct {
+	key string
+	dst *net.IPNet
+	// replace a managed route to dst is installed
+	replace bool
+	// del dst is stale
+	del bool
+}
+
+// Sync make the managed routes inside pools exactly the desired routes: a single kernel snapshot
+// is diffed against the complete desired set, then the adds, replaces and deletes are sent as batches of
+// netlink messages. The routes carrying our marker outside every one of known, all the IPPools whatever
+// their state and the filters, are stale too, e.g. the kept routes of a pool deleted while we were down.
+// Nil known leaves them alone. The routes of the pools removed while the deletes were frozen or refused
+// by the delete breaker are stale too.
+// While the deletes are frozen the stale routes, ip rules and vteps are kept
+func (r *Router) Sync(pools, known []net.IPNet, desired []*types.Route) (SyncResult, error) {
+	start := time.Now()
+	result, changes, allowed, installed, err := r.planSync(pools, known, desired)
+	if err != nil {
+		return result, err
+	}
+
+	total := len(changes)
+	metrics.SyncPendingChanges.Set(float64(total))
+	for done := 0; done < total; {
+		end := done + syncBatch
+		if end > total {
+			end = total
+		}
+		r.mu.Lock()
+		r.applyBatch(changes[done:end], &result)
+		r.mu.Unlock()
+		done = end
+		metrics.SyncPendingChanges.Set(float64(total - done))
+		if total > syncBatch {
+			klog.Infof("full sync progress: %d/%d route changes applied", done, total)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen == "" && allowed {
+		if err := r.netlinkHandle.VTEPSync(desiredVTEPs(desired)); err != nil {
+			klog.Errorf("sync vteps err: %v", err)
+		}
+	}
+	if r.frozen == "" && r.opts.StateFile != "" && !r.opts.DryRun {
+		if err := r.saveState(pools); err != nil {
+			klog.Errorf("save state file %s err: %v", r.opts.StateFile, err)
+		}
+	}
+	if r.opts.DryRun {
+		metrics.InstalledRoutes.Set(float64(installed))
+	} else {
+		metrics.InstalledRoutes.Set(float64(installed + result.Added - result.Deleted))
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// planSync diff the kernel snapshot against the desired routes, which become the desired set at once.
+// Returns the changes to apply, whether the stale vteps can be deleted and the number of managed routes
+func (r *Router) planSync(pools, known []net.IPNet, desired []*types.Route) (SyncResult, []syncChange, bool, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := SyncResult{DryRun: r.opts.DryRun}
+	if r.frozen == "" {
+		if err := r.netlinkHandle.RuleEnsure(pools); err != nil {
+			klog.Errorf("ensure rules err: %v", err)
+		}
+	}
+	snapshot, err := r.netlinkHandle.ManagedRoutes(pools)
+	if err != nil {
+		return result, nil, false, 0, err
+	}
+	if known != nil {
+		orphans, err := r.netlinkHandle.OrphanRoutes(known)
+		if err != nil {
+			return result, nil, false, 0, err
+		}
+		if len(orphans) > 0 {
+			klog.Infof("%d routes outside every IPPool are stale", len(orphans))
+		}
+		snapshot = append(snapshot, orphans...)
+	}
+	installed := map[string][]netlink.Route{}
+	for _, route := range snapshot {
+		key := route.Dst.String()
+		installed[key] = append(installed[key], route)
+	}
+	removed, err := r.removedRoutes(pools)
+	if err != nil {
+		return result, nil, false, 0, err
+	}
+	for _, route := range removed {
+		key := route.Dst.String()
+		if _, ok := installed[key]; !ok {
+			installed[key] = append(installed[key], route)
+		}
+	}
+
+	wanted := make(map[string]*types.Route, len(desired))
+	for _, route := range desired {
+		wanted[route.DstNet.String()] = route
+	}
+	result.Desired = len(wanted)
+
+	var changes []syncChange
+	for key, route := range wanted {
+		current := installed[key]
+		if len(current) == 1 && r.netlinkHandle.RouteMatch(r.localNetworks, &current[0], route) {
+			result.Unchanged++
+			continue
+		}
+		changes = append(changes, syncChange{key: key, dst: route.DstNet, replace: len(current) > 0})
+	}
+	var stale []string
+	for key := range installed {
+		if _, ok := wanted[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	allowed := r.frozen != "" || r.breaker.allow(stale, len(installed))
+	if r.frozen == "" && allowed {
+		r.removed = map[string]*net.IPNet{}
+	}
+	for _, key := range stale {
+		dst := installed[key][0].Dst
+		if r.keep(dst) {
+			result.Kept++
+			continue
+		}
+		if !allowed {
+			result.Blocked++
+			continue
+		}
+		changes = append(changes, syncChange{key: key, dst: dst, del: true})
+	}
+
+	r.desired = wanted
+	r.desiredChanged()
+	return result, changes, allowed, len(installed), nil
+}
+
+// removedRoutes the managed routes of the removed pools, which are not back in pools, r.mu must be held
+func (r *Router) removedRoutes(pools []net.IPNet) ([]netlink.Route, error) {
+	var nets []net.IPNet
+	for key, pool := range r.removed {
+		if util.ContainedInAny(pools, pool) {
+			delete(r.removed, key)
+			continue
+		}
+		nets = append(nets, *pool)
+	}
+	if len(nets) == 0 {
+		return nil, nil
+	}
+	return r.netlinkHandle.ManagedRoutes(nets)
+}
+
+// applyBatch apply the planned changes unless the desired set changed meanwhile, r.mu must be held.
+// They are sent to the kernel together by RouteBatch
+func (r *Router) applyBatch(changes []syncChange, result *SyncResult) {
+	var ensured, deleted []*syncChange
+	var routes []*types.Route
+	var dsts []*net.IPNet
+	for i := range changes {
+		change := &changes[i]
+		route, desired := r.desired[change.key]
+		if change.del {
+			if desired || r.keep(change.dst) {
+				continue
+			}
+			deleted = append(deleted, change)
+			dsts = append(dsts, change.dst)
+			continue
+		}
+		if desired {
+			ensured = append(ensured, change)
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == 0 && len(dsts) == 0 {
+		return
+	}
+	routeErrs, dstErrs := r.netlinkHandle.RouteBatch(r.localNetworks, routes, dsts)
+	for i, err := range routeErrs {
+		switch {
+		case err != nil:
+			klog.Errorf("sync route [%s] err: %v", ensured[i].key, err)
+			result.Failed++
+		case ensured[i].replace:
+			result.Replaced++
+		default:
+			result.Added++
+		}
+	}
+	for i, err := range dstErrs {
+		if err != nil {
+			klog.Errorf("sync stale route [%s] err: %v", deleted[i].key, err)
+			result.Failed++
+			continue
+		}
+		result.Deleted++
+	}
+}
+
+// desiredVTEPs the distinct vteps of the routes through the vxlan overlay
+func desiredVTEPs(desired []*types.Route) []*types.VTEP {
+	var vteps []*types.VTEP
+	seen := map[string]bool{}
+	for _, route := range desired {
+		if route.VTEP == nil || route.VXLANMode == "" || route.VXLANMode == types.EncapNever {
+			continue
+		}
+		if seen[route.VTEP.TunnelIP.String()] {
+			continue
+		}
+		seen[route.VTEP.TunnelIP.String()] = true
+		vteps = append(vteps, route.VTEP)
+	}
+	return vteps
+}
@@ -0,0 +1,103 @@
+package route
+
+import (
+	"net"
+	"testing"
+
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// TestSyncOrphans the marked routes outside every IPPool are deleted, the routes of the filtered out
+// pools and the unmarked ones are left alone
+func TestSyncOrphans(t *testing.T) {
+	local := testNetns(t)
+	r, err := NewRouter(local, Options{Protocol: types.DefaultRouteProtocol, RulePriority: types.DefaultRulePriority, DriftDebounce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKernelRoute(t, "10.64.0.0/26", 2, types.DefaultRouteProtocol)
+	// a pool deleted while we were down
+	testKernelRoute(t, "10.99.0.0/26", 2, types.DefaultRouteProtocol)
+	// a filtered out pool
+	testKernelRoute(t, "10.70.0.0/26", 2, types.DefaultRouteProtocol)
+	testKernelRoute(t, "10.98.0.0/26", 2, unix.RTPROT_STATIC)
+
+	pools := []net.IPNet{*util.ParseNet("10.64.0.0/16")}
+	known := append(pools, *util.ParseNet("10.70.0.0/16"))
+	desired := []*types.Route{{DstNet: util.ParseNet("10.64.0.0/26"), GwIP: net.ParseIP("10.9.0.2")}}
+	result, err := r.Sync(pools, known, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Unchanged != 1 || result.Deleted != 1 || result.Failed != 0 {
+		t.Errorf("sync result %s, want unchanged=1 deleted=1", result)
+	}
+	gws := kernelRoutes(t)
+	if _, ok := gws["10.99.0.0/26"]; ok {
+		t.Errorf("the route outside every pool is not deleted")
+	}
+	for _, dst := range []string{"10.64.0.0/26", "10.70.0.0/26", "10.98.0.0/26"} {
+		if _, ok := gws[dst]; !ok {
+			t.Errorf("route [%s] deleted", dst)
+		}
+	}
+
+	// without the pools known nothing outside pools is touched
+	testKernelRoute(t, "10.99.0.0/26", 2, types.DefaultRouteProtocol)
+	if result, err = r.Sync(pools, nil, desired); err != nil || result.Deleted != 0 {
+		t.Errorf("sync without the known pools: %s, %v", result, err)
+	}
+	if _, ok := kernelRoutes(t)["10.99.0.0/26"]; !ok {
+		t.Errorf("the route outside the pools is deleted without the known pools")
+	}
+}
+
+// TestDeletePoolRoutesBreaker the routes of a removed pool over the delete breaker are left to the full
+// sync, which deletes them once a second full sync confirms them
+func TestDeletePoolRoutesBreaker(t *testing.T) {
+	local := testNetns(t)
+	r, err := NewRouter(local, Options{Protocol: types.DefaultRouteProtocol, RulePriority: types.DefaultRulePriority,
+		DriftDebounce: 1, MaxDeleteCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKernelRoute(t, "10.64.0.0/26", 2, types.DefaultRouteProtocol)
+	testKernelRoute(t, "10.65.0.0/26", 2, types.DefaultRouteProtocol)
+	for _, dst := range []string{"10.70.0.0/26", "10.70.0.64/26", "10.70.0.128/26"} {
+		testKernelRoute(t, dst, 2, types.DefaultRouteProtocol)
+	}
+
+	if err = r.DeletePoolRoutes(util.ParseNet("10.65.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kernelRoutes(t)["10.65.0.0/26"]; ok {
+		t.Errorf("the route of a pool under the breaker is not deleted")
+	}
+	if err = r.DeletePoolRoutes(util.ParseNet("10.70.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kernelRoutes(t)["10.70.0.0/26"]; !ok {
+		t.Fatalf("the routes of a pool over the breaker are deleted at once")
+	}
+
+	// the disabled pool is still known
+	pools := []net.IPNet{*util.ParseNet("10.64.0.0/16")}
+	known := []net.IPNet{pools[0], *util.ParseNet("10.70.0.0/16")}
+	desired := []*types.Route{{DstNet: util.ParseNet("10.64.0.0/26"), GwIP: net.ParseIP("10.9.0.2")}}
+	result, err := r.Sync(pools, known, desired)
+	if err != nil || result.Blocked != 3 || result.Deleted != 0 {
+		t.Fatalf("first sync %s, %v, want blocked=3", result, err)
+	}
+	if result, err = r.Sync(pools, known, desired); err != nil || result.Deleted != 3 {
+		t.Fatalf("second sync %s, %v, want deleted=3", result, err)
+	}
+	gws := kernelRoutes(t)
+	if _, ok := gws["10.70.0.0/26"]; ok || gws["10.64.0.0/26"] == "" {
+		t.Errorf("routes after the confirmed deletes %v", gws)
+	}
+	if len(r.removed) != 0 {
+		t.Errorf("removed pools %v once deleted", r.removed)
+	}
+}
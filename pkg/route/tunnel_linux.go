@@ -0,0 +1,320 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// useIPIP Whether the node is reached through the ipip tunnel device, honouring the IPIPMode of the pool.
+// Calico only supports ipip for ipv4
+func (n netlinkHandle) useIPIP(localNetworks []types.LocalNetwork, dr *types.Route) bool {
+	if !n.ipip || dr.GwIP == nil || util.IPFamily(dr.GwIP) != netlink.FAMILY_V4 {
+		return false
+	}
+	switch dr.IPIPMode {
+	case types.EncapAlways:
+		return true
+	case types.EncapCrossSubnet:
+		return !gwContains(localNetworks, dr)
+	default:
+		return false
+	}
+}
+
+func (n netlinkHandle) TunnelEnsure() error {
+	if n.ipip {
+		if err := n.ipipEnsure(); err != nil {
+			return err
+		}
+	}
+	if n.vxlan {
+		if err := n.vxlanEnsure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipipEnsure create the ipip tunnel device if missing, and bring it up with the configured mtu.
+// The device has no address, the kernel picks the source address of the outer and inner packets
+func (n netlinkHandle) ipipEnsure() error {
+	link, err := n.LinkByName(types.IpIpLink)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return err
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = types.IpIpLink
+		if err = n.LinkAdd(&netlink.Iptun{LinkAttrs: la}); err != nil {
+			return fmt.Errorf("add ipip device [%s] err: %v", types.IpIpLink, err)
+		}
+		klog.Infof("add ipip device [%s]", types.IpIpLink)
+		if link, err = n.LinkByName(types.IpIpLink); err != nil {
+			return err
+		}
+	}
+	if link.Type() != "ipip" {
+		return fmt.Errorf("device [%s] exists but is a %s device", types.IpIpLink, link.Type())
+	}
+	if link.Attrs().MTU != n.ipipMTU {
+		if err = n.LinkSetMTU(link, n.ipipMTU); err != nil {
+			return fmt.Errorf("set mtu of [%s] err: %v", types.IpIpLink, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err = n.LinkSetUp(link); err != nil {
+			return fmt.Errorf("set [%s] up err: %v", types.IpIpLink, err)
+		}
+	}
+	return nil
+}
+
+// onlink make r an onlink route through the tunnel device
+func (n netlinkHandle) onlink(r *netlink.Route, linkName string) error {
+	index, err := n.linkIndex(linkName)
+	if err != nil {
+		return fmt.Errorf("get tunnel device [%s] err: %v", linkName, err)
+	}
+	r.LinkIndex = index
+	r.Flags = int(netlink.FLAG_ONLINK)
+	return nil
+}
+
+// useVXLAN Whether the node is reached through the vxlan device, honouring the VXLANMode of the pool.
+// The node must have published its vtep, only the ipv4 overlay is supported
+func (n netlinkHandle) useVXLAN(localNetworks []types.LocalNetwork, dr *types.Route) bool {
+	if !n.vxlan || dr.VTEP == nil || dr.GwIP == nil || util.IPFamily(dr.GwIP) != netlink.FAMILY_V4 {
+		return false
+	}
+	switch dr.VXLANMode {
+	case types.EncapAlways:
+		return true
+	case types.EncapCrossSubnet:
+		return !gwContains(localNetworks, dr)
+	default:
+		return false
+	}
+}
+
+// vxlanEnsure create the vxlan device if missing, and bring it up with the configured mtu.
+// Learning is off, the remote vteps are programmed as static neighbour and fdb entries like calico/node does
+func (n netlinkHandle) vxlanEnsure() error {
+	link, err := n.LinkByName(types.VXLANLink)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return err
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = types.VXLANLink
+		la.MTU = n.vxlanMTU
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: la,
+			VxlanId:   n.vxlanVNI,
+			Port:      n.vxlanPort,
+			Learning:  false,
+		}
+		if err = n.LinkAdd(vxlan); err != nil {
+			return fmt.Errorf("add vxlan device [%s] err: %v", types.VXLANLink, err)
+		}
+		klog.Infof("add vxlan device [%s] vni %d port %d", types.VXLANLink, n.vxlanVNI, n.vxlanPort)
+		if link, err = n.LinkByName(types.VXLANLink); err != nil {
+			return err
+		}
+	}
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return fmt.Errorf("device [%s] exists but is a %s device", types.VXLANLink, link.Type())
+	}
+	if vxlan.VxlanId != n.vxlanVNI || vxlan.Port != n.vxlanPort {
+		return fmt.Errorf("device [%s] exists with vni %d port %d, expected vni %d port %d",
+			types.VXLANLink, vxlan.VxlanId, vxlan.Port, n.vxlanVNI, n.vxlanPort)
+	}
+	if link.Attrs().MTU != n.vxlanMTU {
+		if err = n.LinkSetMTU(link, n.vxlanMTU); err != nil {
+			return fmt.Errorf("set mtu of [%s] err: %v", types.VXLANLink, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err = n.LinkSetUp(link); err != nil {
+			return fmt.Errorf("set [%s] up err: %v", types.VXLANLink, err)
+		}
+	}
+	return nil
+}
+
+// vtepNeighs the arp and fdb entries of the vtep on the vxlan device
+func vtepNeighs(linkIndex int, vtep *types.VTEP) (*netlink.Neigh, *netlink.Neigh) {
+	arp := &netlink.Neigh{
+		LinkIndex:    linkIndex,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		Type:         unix.RTN_UNICAST,
+		IP:           vtep.TunnelIP,
+		HardwareAddr: vtep.MAC,
+	}
+	fdb := &netlink.Neigh{
+		LinkIndex:    linkIndex,
+		Family:       unix.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		State:        netlink.NUD_PERMANENT,
+		IP:           vtep.NodeIP,
+		HardwareAddr: vtep.MAC,
+	}
+	return arp, fdb
+}
+
+// vtepCache the vteps programmed on the vxlan device, so that an unchanged vtep is not programmed again.
+// The full sync programs them all again, in case the entries were changed by others
+type vtepCache struct {
+	mu sync.Mutex
+	// vteps the programmed vteps by tunnel address, with the index of the device
+	vteps map[string]string
+}
+
+func vtepKey(linkIndex int, vtep *types.VTEP) string {
+	return fmt.Sprintf("%d/%s/%s", linkIndex, vtep.MAC, vtep.NodeIP)
+}
+
+func (c *vtepCache) programmed(linkIndex int, vtep *types.VTEP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.vteps[vtep.TunnelIP.String()] == vtepKey(linkIndex, vtep)
+}
+
+func (c *vtepCache) set(linkIndex int, vtep *types.VTEP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.vteps == nil {
+		c.vteps = map[string]string{}
+	}
+	c.vteps[vtep.TunnelIP.String()] = vtepKey(linkIndex, vtep)
+}
+
+func (c *vtepCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vteps = nil
+}
+
+// vtepProgrammed whether the vtep is programmed on the vxlan device as is
+func (n netlinkHandle) vtepProgrammed(vtep *types.VTEP) bool {
+	index, err := n.linkIndex(types.VXLANLink)
+	return err == nil && n.vteps.programmed(index, vtep)
+}
+
+// vtepEnsure program the arp and fdb entries of the vtep
+func (n netlinkHandle) vtepEnsure(vtep *types.VTEP) error {
+	index, err := n.linkIndex(types.VXLANLink)
+	if err != nil {
+		return fmt.Errorf("get vxlan device [%s] err: %v", types.VXLANLink, err)
+	}
+	arp, fdb := vtepNeighs(index, vtep)
+	if err = n.NeighSet(arp); err != nil {
+		metrics.NetlinkErrors.WithLabelValues("neigh_set").Inc()
+		return fmt.Errorf("set arp entry %s -> %s err: %v", vtep.TunnelIP, vtep.MAC, err)
+	}
+	if err = n.NeighSet(fdb); err != nil {
+		metrics.NetlinkErrors.WithLabelValues("neigh_set").Inc()
+		return fmt.Errorf("set fdb entry %s -> %s err: %v", vtep.MAC, vtep.NodeIP, err)
+	}
+	n.vteps.set(index, vtep)
+	return nil
+}
+
+// installedVTEPs the vteps programmed on the vxlan device by tunnel address, from the permanent
+// arp entries and the fdb entries of their mac
+func (n netlinkHandle) installedVTEPs() (map[string]*types.VTEP, error) {
+	index, err := n.linkIndex(types.VXLANLink)
+	if err != nil {
+		return nil, fmt.Errorf("get vxlan device [%s] err: %v", types.VXLANLink, err)
+	}
+	fdbs, err := n.NeighList(index, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	nodeIPs := map[string]net.IP{}
+	for i := range fdbs {
+		if fdbs[i].IP != nil {
+			nodeIPs[fdbs[i].HardwareAddr.String()] = fdbs[i].IP
+		}
+	}
+	arps, err := n.NeighList(index, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	vteps := map[string]*types.VTEP{}
+	for i := range arps {
+		nodeIP, ok := nodeIPs[arps[i].HardwareAddr.String()]
+		if !ok || arps[i].State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		vteps[arps[i].IP.String()] = &types.VTEP{TunnelIP: arps[i].IP, MAC: arps[i].HardwareAddr, NodeIP: nodeIP}
+	}
+	return vteps, nil
+}
+
+func (n netlinkHandle) VTEPSync(vteps []*types.VTEP) error {
+	if !n.vxlan {
+		return nil
+	}
+	index, err := n.linkIndex(types.VXLANLink)
+	if err != nil {
+		return fmt.Errorf("get vxlan device [%s] err: %v", types.VXLANLink, err)
+	}
+	wantedArp := map[string]string{}
+	wantedFdb := map[string]string{}
+	var errs []error
+	n.vteps.reset()
+	for _, vtep := range vteps {
+		wantedArp[vtep.TunnelIP.String()] = vtep.MAC.String()
+		wantedFdb[vtep.MAC.String()] = vtep.NodeIP.String()
+		if err = n.vtepEnsure(vtep); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	arps, err := n.NeighList(index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for i := range arps {
+		if mac, ok := wantedArp[arps[i].IP.String()]; ok && mac == arps[i].HardwareAddr.String() {
+			continue
+		}
+		if arps[i].State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		if err = n.NeighDel(&arps[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		klog.Infof("del stale arp entry %s -> %s", arps[i].IP, arps[i].HardwareAddr)
+	}
+	fdbs, err := n.NeighList(index, unix.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	for i := range fdbs {
+		if fdbs[i].IP == nil {
+			continue
+		}
+		if ip, ok := wantedFdb[fdbs[i].HardwareAddr.String()]; ok && ip == fdbs[i].IP.String() {
+			continue
+		}
+		if err = n.NeighDel(&fdbs[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		klog.Infof("del stale fdb entry %s -> %s", fdbs[i].HardwareAddr, fdbs[i].IP)
+	}
+	return utilerrors.NewAggregate(errs)
+}
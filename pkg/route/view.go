@@ -0,0 +1,194 @@
+package route
+
+import (
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// routeView an in-memory view of the routes of our table indexed by dst, and of the link names,
+// so that checking a route costs no syscall. The routes are current only while the kernel route
+// updates are subscribed, the links while the link updates are, otherwise the kernel is asked
+type routeView struct {
+	table int
+
+	mu sync.RWMutex
+	// current whether routes follows the kernel
+	current bool
+	// routes the routes of the table by dst cidr, ours and the others
+	routes map[string][]netlink.Route
+	// tracked whether links follows the kernel
+	tracked bool
+	// links the names of the links by index
+	links map[int]string
+}
+
+func newRouteView(table int) *routeView {
+	return &routeView{table: table}
+}
+
+// reload replace the routes by a dump of the table, the view is current from now on.
+// Only called by the goroutine applying the updates, which then applies the ones queued meanwhile
+func (v *routeView) reload() error {
+	routes, err := routeListFiltered(&netlink.Handle{}, netlink.FAMILY_ALL, &netlink.Route{Table: v.table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string][]netlink.Route, len(routes))
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+		key := route.Dst.String()
+		indexed[key] = append(indexed[key], route)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.routes = indexed
+	v.current = true
+	klog.V(2).Infof("route view reloaded, %d routes", len(routes))
+	return nil
+}
+
+// invalidate stop serving the routes, the updates are not followed anymore
+func (v *routeView) invalidate() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.current = false
+	v.routes = nil
+}
+
+// apply a kernel route update
+func (v *routeView) apply(update *netlink.RouteUpdate) {
+	if update.Dst == nil || update.Table != v.table {
+		return
+	}
+	switch update.Type {
+	case unix.RTM_NEWROUTE:
+		v.added(update.Route)
+	case unix.RTM_DELROUTE:
+		v.deleted(update.Route)
+	}
+}
+
+// added record a route added or replaced, it replaces the route with the same key.
+// The route is held with the metric the kernel reports, like the routes of the updates
+func (v *routeView) added(route netlink.Route) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.current {
+		return
+	}
+	route.Priority = kernelPriority(&route)
+	key := route.Dst.String()
+	v.routes[key] = append(withoutKey(v.routes[key], &route), route)
+}
+
+// deleted record a route deleted
+func (v *routeView) deleted(route netlink.Route) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.current {
+		return
+	}
+	key := route.Dst.String()
+	if routes := withoutKey(v.routes[key], &route); len(routes) > 0 {
+		v.routes[key] = routes
+	} else {
+		delete(v.routes, key)
+	}
+}
+
+// withoutKey the routes but the ones the kernel identifies as route
+func withoutKey(routes []netlink.Route, route *netlink.Route) []netlink.Route {
+	var kept []netlink.Route
+	for i := range routes {
+		if !sameRouteKey(&routes[i], route) {
+			kept = append(kept, routes[i])
+		}
+	}
+	return kept
+}
+
+// to a copy of the routes to dst, false when the view is not current
+func (v *routeView) to(dst *net.IPNet) ([]netlink.Route, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if !v.current {
+		return nil, false
+	}
+	return append([]netlink.Route(nil), v.routes[dst.String()]...), true
+}
+
+// all a copy of the routes of the family, false when the view is not current
+func (v *routeView) all(family int) ([]netlink.Route, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if !v.current {
+		return nil, false
+	}
+	routes := make([]netlink.Route, 0, len(v.routes))
+	for _, to := range v.routes {
+		for i := range to {
+			if family == netlink.FAMILY_ALL || util.IPFamily(to[i].Dst.IP) == family {
+				routes = append(routes, to[i])
+			}
+		}
+	}
+	return routes, true
+}
+
+// trackLinks start or stop caching the link names, a cache not followed is dropped
+func (v *routeView) trackLinks(tracked bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tracked = tracked
+	v.links = nil
+}
+
+// linkName the cached name of the link, false when unknown
+func (v *routeView) linkName(index int) (string, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	name, ok := v.links[index]
+	return name, ok
+}
+
+// linkIndex the cached index of the link, false when unknown
+func (v *routeView) linkIndex(name string) (int, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for index, linkName := range v.links {
+		if linkName == name {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// setLinkName cache the name of the link looked up, only while the link updates are followed
+func (v *routeView) setLinkName(index int, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.tracked {
+		return
+	}
+	if v.links == nil {
+		v.links = map[int]string{}
+	}
+	v.links[index] = name
+}
+
+// linkUpdate apply a kernel link update, a renamed or deleted link is looked up again
+func (v *routeView) linkUpdate(update *netlink.LinkUpdate) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if update.Link == nil {
+		return
+	}
+	delete(v.links, update.Link.Attrs().Index)
+}
@@ -0,0 +1,318 @@
+package route
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	"github.com/yzxiu/calico-route-sync/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// testView a current view of the main table without any route
+func testView() *routeView {
+	view := newRouteView(unix.RT_TABLE_MAIN)
+	view.current = true
+	view.routes = map[string][]netlink.Route{}
+	return view
+}
+
+func testRoute(dst, gw string, protocol netlink.RouteProtocol, priority int) netlink.Route {
+	return netlink.Route{
+		Dst:      util.ParseNet(dst),
+		Gw:       net.ParseIP(gw),
+		Protocol: protocol,
+		Priority: priority,
+		Table:    unix.RT_TABLE_MAIN,
+	}
+}
+
+// viewGws the gateways of the routes of the view to dst, false when the view is not current
+func viewGws(v *routeView, dst string) ([]string, bool) {
+	routes, ok := v.to(util.ParseNet(dst))
+	gws := []string{}
+	for i := range routes {
+		gws = append(gws, routes[i].Gw.String())
+	}
+	return gws, ok
+}
+
+func TestViewApply(t *testing.T) {
+	const ours, static = netlink.RouteProtocol(types.DefaultRouteProtocol), netlink.RouteProtocol(unix.RTPROT_STATIC)
+	foreignTable := testRoute("10.64.0.0/26", "10.0.0.9", ours, 0)
+	foreignTable.Table = 100
+	tests := []struct {
+		name   string
+		update netlink.RouteUpdate
+		// want the gateways of the routes to 10.64.0.0/26 after the update
+		want []string
+	}{
+		{"add", netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.2", ours, 0)},
+			[]string{"10.0.0.2"}},
+		{"replace same key", netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.3", ours, 0)},
+			[]string{"10.0.0.3"}},
+		{"add foreign with another metric", netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.4", static, 100)},
+			[]string{"10.0.0.3", "10.0.0.4"}},
+		{"other table ignored", netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: foreignTable},
+			[]string{"10.0.0.3", "10.0.0.4"}},
+		{"no dst ignored", netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: netlink.Route{Table: unix.RT_TABLE_MAIN}},
+			[]string{"10.0.0.3", "10.0.0.4"}},
+		{"other dst", netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: testRoute("10.64.0.64/26", "10.0.0.5", ours, 0)},
+			[]string{"10.0.0.3", "10.0.0.4"}},
+		{"delete ours", netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.3", ours, 0)},
+			[]string{"10.0.0.4"}},
+		{"delete unknown", netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.6", ours, 50)},
+			[]string{"10.0.0.4"}},
+		{"delete foreign", netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: testRoute("10.64.0.0/26", "10.0.0.4", static, 100)},
+			[]string{}},
+	}
+	view := testView()
+	for _, tt := range tests {
+		view.apply(&tt.update)
+		gws, ok := viewGws(view, "10.64.0.0/26")
+		if !ok {
+			t.Fatalf("%s: view not current", tt.name)
+		}
+		if strings.Join(gws, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: routes via %v, want %v", tt.name, gws, tt.want)
+		}
+	}
+	if _, ok := view.routes["10.64.0.0/26"]; ok {
+		t.Errorf("the dst without route is kept in the view")
+	}
+	if gws, _ := viewGws(view, "10.64.0.64/26"); len(gws) != 1 {
+		t.Errorf("routes to 10.64.0.64/26 via %v, want one", gws)
+	}
+}
+
+func TestViewAddedDeleted(t *testing.T) {
+	view := testView()
+	route := testRoute("fd00:10::/122", "fd00::2", types.DefaultRouteProtocol, ip6DefaultPriority)
+	view.added(route)
+	view.added(testRoute("10.64.0.0/26", "10.0.0.2", types.DefaultRouteProtocol, 0))
+	if routes, _ := view.all(netlink.FAMILY_V6); len(routes) != 1 || !routes[0].Gw.Equal(route.Gw) {
+		t.Errorf("ipv6 routes %v, want the route via %s", routes, route.Gw)
+	}
+	// the route we add without a metric, then its update carrying the metric of the kernel
+	view.added(testRoute("fd00:10::/122", "fd00::3", types.DefaultRouteProtocol, 0))
+	view.apply(&netlink.RouteUpdate{Type: unix.RTM_NEWROUTE,
+		Route: testRoute("fd00:10::/122", "fd00::3", types.DefaultRouteProtocol, ip6DefaultPriority)})
+	routes, _ := view.to(route.Dst)
+	if len(routes) != 1 || !routes[0].Gw.Equal(net.ParseIP("fd00::3")) || routes[0].Priority != ip6DefaultPriority {
+		t.Errorf("ipv6 routes %v after the replace, want a single route via fd00::3 of metric %d", routes, ip6DefaultPriority)
+	}
+	if routes, _ := view.all(netlink.FAMILY_ALL); len(routes) != 2 {
+		t.Errorf("%d routes, want 2", len(routes))
+	}
+	view.deleted(route)
+	if routes, _ := view.all(netlink.FAMILY_V6); len(routes) != 0 {
+		t.Errorf("ipv6 routes %v after delete, want none", routes)
+	}
+}
+
+func TestViewToCopy(t *testing.T) {
+	view := testView()
+	view.added(testRoute("10.64.0.0/26", "10.0.0.2", types.DefaultRouteProtocol, 0))
+	routes, _ := view.to(util.ParseNet("10.64.0.0/26"))
+	routes[0].Gw = net.ParseIP("10.0.0.9")
+	if gws, _ := viewGws(view, "10.64.0.0/26"); gws[0] != "10.0.0.2" {
+		t.Errorf("the view changed through the routes returned: via %v", gws)
+	}
+}
+
+func TestViewNotCurrent(t *testing.T) {
+	view := newRouteView(unix.RT_TABLE_MAIN)
+	route := testRoute("10.64.0.0/26", "10.0.0.2", types.DefaultRouteProtocol, 0)
+	view.added(route)
+	view.apply(&netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route})
+	if _, ok := view.to(route.Dst); ok {
+		t.Errorf("a view never loaded is current")
+	}
+	if _, ok := view.all(netlink.FAMILY_ALL); ok {
+		t.Errorf("a view never loaded is current")
+	}
+
+	view = testView()
+	view.added(route)
+	view.invalidate()
+	if _, ok := view.to(route.Dst); ok {
+		t.Errorf("an invalidated view is current")
+	}
+	view.added(route)
+	if view.routes != nil {
+		t.Errorf("an invalidated view records the routes added")
+	}
+}
+
+func TestViewReload(t *testing.T) {
+	view := newRouteView(unix.RT_TABLE_MAIN)
+	if err := view.reload(); err != nil {
+		t.Skipf("route dump not permitted: %v", err)
+	}
+	routes, ok := view.all(netlink.FAMILY_ALL)
+	if !ok {
+		t.Fatalf("a reloaded view is not current")
+	}
+	dump, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Skipf("route dump not permitted: %v", err)
+	}
+	var want int
+	for i := range dump {
+		if dump[i].Dst != nil {
+			want++
+			if to, _ := view.to(dump[i].Dst); len(to) == 0 {
+				t.Errorf("route to [%s] missing from the view", dump[i].Dst)
+			}
+		}
+	}
+	if len(routes) != want {
+		t.Errorf("%d routes in the view, want %d", len(routes), want)
+	}
+}
+
+func TestViewLinks(t *testing.T) {
+	view := newRouteView(unix.RT_TABLE_MAIN)
+	view.setLinkName(2, "eth0")
+	if _, ok := view.linkName(2); ok {
+		t.Errorf("a link name is cached while the links are not tracked")
+	}
+	view.trackLinks(true)
+	view.setLinkName(2, "eth0")
+	if name, ok := view.linkName(2); !ok || name != "eth0" {
+		t.Errorf("link 2 named %q, want eth0", name)
+	}
+	if index, ok := view.linkIndex("eth0"); !ok || index != 2 {
+		t.Errorf("link eth0 index %d, want 2", index)
+	}
+	la := netlink.NewLinkAttrs()
+	la.Index, la.Name = 2, "eth1"
+	view.linkUpdate(&netlink.LinkUpdate{Link: &netlink.Dummy{LinkAttrs: la}})
+	if _, ok := view.linkIndex("eth0"); ok {
+		t.Errorf("a renamed link is still cached")
+	}
+	view.setLinkName(3, "eth0")
+	view.trackLinks(false)
+	if _, ok := view.linkName(3); ok {
+		t.Errorf("a link name is cached after the links are not tracked anymore")
+	}
+}
+
+// TestRouteEnsureVXLANUnchanged an unchanged route through vxlan is served by the view and the
+// vtep cache, the host has no vxlan device so that any syscall fails
+func TestRouteEnsureVXLANUnchanged(t *testing.T) {
+	const vxlanIndex = 1000
+	opts := Options{Protocol: types.DefaultRouteProtocol, VXLAN: true}
+	view := testView()
+	view.trackLinks(true)
+	view.setLinkName(vxlanIndex, types.VXLANLink)
+	n := newNetLinkHandle(opts, view)
+
+	vtep := &types.VTEP{
+		TunnelIP: net.ParseIP("10.65.0.2"),
+		MAC:      net.HardwareAddr{0x66, 0, 0, 0, 0, 2},
+		NodeIP:   net.ParseIP("192.168.0.2"),
+	}
+	route := &types.Route{DstNet: util.ParseNet("10.64.0.0/26"), GwIP: vtep.NodeIP, VXLANMode: types.EncapAlways, VTEP: vtep}
+	installed := testRoute("10.64.0.0/26", "10.65.0.2", types.DefaultRouteProtocol, 0)
+	installed.LinkIndex = vxlanIndex
+	view.added(installed)
+	n.vteps.set(vxlanIndex, vtep)
+
+	if err := n.RouteEnsure(nil, route); err != nil {
+		t.Errorf("ensure unchanged route: %v", err)
+	}
+	moved := *vtep
+	moved.MAC = net.HardwareAddr{0x66, 0, 0, 0, 0, 3}
+	route.VTEP = &moved
+	if err := n.RouteEnsure(nil, route); err == nil {
+		t.Errorf("the changed vtep is not programmed")
+	}
+}
+
+// benchBlocks the /26 blocks of a large cluster, one route each in the view
+const benchBlocks = 16384
+
+// benchLinkIndex the index of the link the nodes are reached through
+const benchLinkIndex = 2
+
+// benchHandle a handle whose view holds the routes of benchBlocks blocks via as many nodes,
+// none of the benchmarked checks makes a syscall
+func benchHandle(b *testing.B) (*netlinkHandle, []types.LocalNetwork, []*types.Route) {
+	b.Helper()
+	opts := Options{Protocol: types.DefaultRouteProtocol}
+	view := newRouteView(opts.table())
+	view.current = true
+	view.routes = map[string][]netlink.Route{}
+	view.trackLinks(true)
+	view.setLinkName(benchLinkIndex, "eth0")
+	n := newNetLinkHandle(opts, view)
+
+	nodes := util.ParseNet("10.0.0.0/16")
+	local := []types.LocalNetwork{{
+		LinkName: "eth0",
+		LocalIp4: []types.IP4{{Net: nodes, IP: util.NthIP(nodes, 1)}},
+	}}
+	pool := util.ParseNet("10.64.0.0/10")
+	routes := make([]*types.Route, 0, benchBlocks)
+	for i := 0; i < benchBlocks; i++ {
+		dst := &net.IPNet{IP: util.NthIP(pool, i*64), Mask: net.CIDRMask(26, 32)}
+		route := &types.Route{DstNet: dst, GwIP: util.NthIP(nodes, i+2)}
+		routes = append(routes, route)
+		view.routes[dst.String()] = []netlink.Route{{
+			Dst:       dst,
+			Gw:        route.GwIP,
+			LinkIndex: benchLinkIndex,
+			Protocol:  netlink.RouteProtocol(opts.Protocol),
+			Table:     opts.table(),
+		}}
+	}
+	return n, local, routes
+}
+
+func BenchmarkRouteExist(b *testing.B) {
+	n, local, routes := benchHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !n.RouteExist(local, routes[i%len(routes)]) {
+			b.Fatalf("route [%s] not found", routes[i%len(routes)].DstNet)
+		}
+	}
+}
+
+func BenchmarkRouteEnsureUnchanged(b *testing.B) {
+	n, local, routes := benchHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := n.RouteEnsure(local, routes[i%len(routes)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkManagedRoutes the snapshot taken by a full sync
+func BenchmarkManagedRoutes(b *testing.B) {
+	n, _, _ := benchHandle(b)
+	pools := []net.IPNet{*util.ParseNet("10.64.0.0/10")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		routes, err := n.ManagedRoutes(pools)
+		if err != nil || len(routes) != benchBlocks {
+			b.Fatalf("%d routes, err: %v", len(routes), err)
+		}
+	}
+}
+
+func BenchmarkViewApply(b *testing.B) {
+	n, _, routes := benchHandle(b)
+	updates := make([]netlink.RouteUpdate, 0, len(routes))
+	for _, route := range routes {
+		updates = append(updates, netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: n.view.routes[route.DstNet.String()][0]})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.view.apply(&updates[i%len(updates)])
+	}
+}
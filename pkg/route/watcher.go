@@ -0,0 +1,224 @@
+package route
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/metrics"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// maxRepairs repairs of a single route within repairWindow,
+	// more means another daemon is fighting over it
+	maxRepairs   = 5
+	repairWindow = time.Minute
+	// maxHoldOff upper bound of the exponential hold off of a fought over route
+	maxHoldOff = 10 * time.Minute
+	// resubscribeDelay wait before subscribing again after the subscription broke
+	resubscribeDelay = 5 * time.Second
+	// viewReload period of the full reload of the route view, in case an update was lost
+	viewReload = 10 * time.Minute
+	// routeReceiveBuffer socket buffer of the route subscription, a full table churns many updates at once
+	routeReceiveBuffer = 4 << 20
+)
+
+// repairHistory recent repairs of a single route
+type repairHistory struct {
+	count       int
+	windowStart time.Time
+	holdOff     time.Duration
+	holdUntil   time.Time
+}
+
+// driftWatcher repairs the desired routes deleted or rewritten by others
+type driftWatcher struct {
+	router   *Router
+	debounce time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	history map[string]*repairHistory
+}
+
+func newDriftWatcher(router *Router, debounce time.Duration) *driftWatcher {
+	return &driftWatcher{
+		router:   router,
+		debounce: debounce,
+		pending:  map[string]*time.Timer{},
+		history:  map[string]*repairHistory{},
+	}
+}
+
+// WatchRoutes subscribe to the kernel route updates, keep the route view current and repair
+// the drift of the desired routes, blocks until ctx is done
+func (r *Router) WatchRoutes(ctx context.Context) error {
+	for {
+		ch := make(chan netlink.RouteUpdate, 1024)
+		done := make(chan struct{})
+		err := netlink.RouteSubscribeWithOptions(ch, done, netlink.RouteSubscribeOptions{
+			ErrorCallback: func(err error) {
+				klog.Errorf("route subscription err: %v", err)
+			},
+			ReceiveBufferSize: routeReceiveBuffer,
+		})
+		if err == nil {
+			// the updates queued meanwhile are applied over the dump
+			err = r.view.reload()
+		}
+		if err != nil {
+			klog.Errorf("subscribe routes err: %v", err)
+		} else {
+			klog.Info("watching kernel route updates")
+			r.drift.consume(ctx, ch)
+		}
+		r.view.invalidate()
+		close(done)
+		r.drift.stop()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// consume handle the updates until ctx is done or the subscription is closed
+func (w *driftWatcher) consume(ctx context.Context, ch <-chan netlink.RouteUpdate) {
+	reload := time.NewTicker(viewReload)
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-ch:
+			if !ok {
+				klog.Warning("route subscription closed")
+				return
+			}
+			w.router.view.apply(&update)
+			w.handle(&update)
+		case <-reload.C:
+			if err := w.router.view.reload(); err != nil {
+				klog.Errorf("reload route view err: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func (w *driftWatcher) handle(update *netlink.RouteUpdate) {
+	if update.Dst == nil || update.Table != w.router.opts.table() {
+		return
+	}
+	key := update.Dst.String()
+	r := w.router
+	r.mu.Lock()
+	desired, ok := r.desired[key]
+	// our own add: the next hop and interface of the desired route, the vtep tunnel address through vxlan
+	own := ok && update.Type == unix.RTM_NEWROUTE && r.netlinkHandle.RouteMatch(r.localNetworks, &update.Route, desired)
+	r.mu.Unlock()
+	if !ok || own {
+		return
+	}
+	klog.V(2).Infof("route [%s] changed by others: %s", key, update.Route)
+	w.schedule(key, w.debounce)
+}
+
+// schedule (re)start the debounce timer of the route
+func (w *driftWatcher) schedule(key string, delay time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.pending[key]; ok {
+		timer.Reset(delay)
+		return
+	}
+	w.pending[key] = time.AfterFunc(delay, func() {
+		w.mu.Lock()
+		delete(w.pending, key)
+		w.mu.Unlock()
+		w.repair(key)
+	})
+}
+
+// stop drop the pending repairs
+func (w *driftWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, timer := range w.pending {
+		timer.Stop()
+		delete(w.pending, key)
+	}
+}
+
+// allow Whether the route can be repaired now, returns the hold off when another daemon fights over it
+func (w *driftWatcher) allow(key string) (bool, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	h, ok := w.history[key]
+	if !ok {
+		h = &repairHistory{windowStart: now}
+		w.history[key] = h
+	}
+	if now.Before(h.holdUntil) {
+		return false, h.holdUntil.Sub(now)
+	}
+	if now.Sub(h.windowStart) > repairWindow {
+		// quiet for long enough, forget the earlier fights
+		if now.Sub(h.windowStart) > maxHoldOff {
+			h.holdOff = 0
+		}
+		h.count = 0
+		h.windowStart = now
+	}
+	h.count++
+	if h.count <= maxRepairs {
+		return true, 0
+	}
+	if h.holdOff == 0 {
+		h.holdOff = repairWindow
+	} else if h.holdOff < maxHoldOff {
+		h.holdOff *= 2
+		if h.holdOff > maxHoldOff {
+			h.holdOff = maxHoldOff
+		}
+	}
+	h.holdUntil = now.Add(h.holdOff)
+	h.count = 0
+	h.windowStart = h.holdUntil
+	return false, h.holdOff
+}
+
+func (w *driftWatcher) repair(key string) {
+	r := w.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	desired, ok := r.desired[key]
+	if !ok {
+		w.mu.Lock()
+		delete(w.history, key)
+		w.mu.Unlock()
+		return
+	}
+	if r.netlinkHandle.RouteExist(r.localNetworks, desired) {
+		return
+	}
+	allowed, holdOff := w.allow(key)
+	if !allowed {
+		klog.Warningf("route [%s] keeps being changed by others, hold off repairing for %s", key, holdOff)
+		w.schedule(key, holdOff)
+		return
+	}
+	klog.Infof("repair drifted route [%s] via [%s]", key, desired.GwIP)
+	err := r.netlinkHandle.RouteEnsure(r.localNetworks, desired)
+	if err != nil {
+		klog.Errorf("repair route [%s] err: %v", key, err)
+		metrics.DriftRepairs.WithLabelValues(metrics.ResultError).Inc()
+		return
+	}
+	metrics.DriftRepairs.WithLabelValues(metrics.ResultSuccess).Inc()
+}
@@ -0,0 +1,408 @@
+// Package selector evaluates Calico label selectors, e.g. the nodeSelector of an IPPool:
+//
+//	all(), global(), has(k), k == "v", k != "v", k in {"a", "b"}, k not in {"a"},
+//	k contains "s", k starts with "s", k ends with "s", !expr, expr && expr, expr || expr, (expr)
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Selector a parsed Calico selector
+type Selector interface {
+	// Matches whether the labels are selected
+	Matches(labels map[string]string) bool
+	// String the selector in Calico syntax
+	String() string
+}
+
+// Parse parse a Calico selector, the empty selector selects everything
+func Parse(s string) (Selector, error) {
+	p := &parser{input: s}
+	p.next()
+	if p.tok.kind == tokEOF && p.err == nil {
+		return all{}, nil
+	}
+	sel, err := p.parseOr()
+	if err == nil {
+		err = p.err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %v", s, err)
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("invalid selector %q: unexpected %q at %d", s, p.tok.text, p.tok.pos)
+	}
+	return sel, nil
+}
+
+type all struct{}
+
+func (all) Matches(map[string]string) bool { return true }
+func (all) String() string                 { return "all()" }
+
+type has struct{ key string }
+
+func (s has) Matches(labels map[string]string) bool {
+	_, ok := labels[s.key]
+	return ok
+}
+func (s has) String() string { return fmt.Sprintf("has(%s)", s.key) }
+
+// compare a label operation, a missing label only matches the negative operators
+type compare struct {
+	key    string
+	op     string
+	values []string
+}
+
+func (s compare) Matches(labels map[string]string) bool {
+	value, ok := labels[s.key]
+	switch s.op {
+	case "!=":
+		return !ok || value != s.values[0]
+	case "not in":
+		return !ok || !contains(s.values, value)
+	}
+	if !ok {
+		return false
+	}
+	switch s.op {
+	case "==":
+		return value == s.values[0]
+	case "in":
+		return contains(s.values, value)
+	case "contains":
+		return strings.Contains(value, s.values[0])
+	case "starts with":
+		return strings.HasPrefix(value, s.values[0])
+	case "ends with":
+		return strings.HasSuffix(value, s.values[0])
+	}
+	return false
+}
+
+func (s compare) String() string {
+	if s.op == "in" || s.op == "not in" {
+		quoted := make([]string, 0, len(s.values))
+		for _, v := range s.values {
+			quoted = append(quoted, quote(v))
+		}
+		return fmt.Sprintf("%s %s {%s}", s.key, s.op, strings.Join(quoted, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", s.key, s.op, quote(s.values[0]))
+}
+
+// quote the value as a Calico string, which has no escapes: single quoted when it holds a double quote
+func quote(value string) string {
+	if strings.IndexByte(value, '"') >= 0 {
+		return "'" + value + "'"
+	}
+	return `"` + value + `"`
+}
+
+type not struct{ sel Selector }
+
+func (s not) Matches(labels map[string]string) bool { return !s.sel.Matches(labels) }
+func (s not) String() string                        { return "!" + s.sel.String() }
+
+type and []Selector
+
+func (s and) Matches(labels map[string]string) bool {
+	for _, sel := range s {
+		if !sel.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+func (s and) String() string { return join(s, " && ") }
+
+type or []Selector
+
+func (s or) Matches(labels map[string]string) bool {
+	for _, sel := range s {
+		if sel.Matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+func (s or) String() string { return join(s, " || ") }
+
+func join(sels []Selector, sep string) string {
+	parts := make([]string, 0, len(sels))
+	for _, sel := range sels {
+		parts = append(parts, sel.String())
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type parser struct {
+	input string
+	pos   int
+	tok   token
+	err   error
+}
+
+// isKeyChar the characters of a label key, or of the all/has/in keywords
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '/' || c == '-'
+}
+
+// next scan the next token into p.tok
+func (p *parser) next() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.input) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return
+	}
+	c := p.input[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		end := strings.IndexByte(p.input[p.pos+1:], c)
+		if end < 0 {
+			p.fail(fmt.Errorf("unterminated string at %d", start))
+			p.tok = token{kind: tokEOF, pos: start}
+			return
+		}
+		p.tok = token{kind: tokString, text: p.input[p.pos+1 : p.pos+1+end], pos: start}
+		p.pos += end + 2
+	case isKeyChar(c):
+		for p.pos < len(p.input) && isKeyChar(p.input[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokIdent, text: p.input[start:p.pos], pos: start}
+	default:
+		for _, op := range []string{"&&", "||", "==", "!=", "!", "(", ")", "{", "}", ","} {
+			if strings.HasPrefix(p.input[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = token{kind: tokOp, text: op, pos: start}
+				return
+			}
+		}
+		p.fail(fmt.Errorf("unexpected %q at %d", c, start))
+		p.tok = token{kind: tokEOF, pos: start}
+	}
+}
+
+func (p *parser) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) isIdent(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.text == word
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected("\"" + op + "\"")
+	}
+	p.next()
+	return p.err
+}
+
+func (p *parser) unexpected(want string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.tok.kind == tokEOF {
+		return fmt.Errorf("expected %s at end", want)
+	}
+	return fmt.Errorf("expected %s at %d, got %q", want, p.tok.pos, p.tok.text)
+}
+
+func (p *parser) parseOr() (Selector, error) {
+	sel, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	sels := or{sel}
+	for p.isOp("||") {
+		p.next()
+		if sel, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 1 {
+		return sels[0], nil
+	}
+	return sels, nil
+}
+
+func (p *parser) parseAnd() (Selector, error) {
+	sel, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	sels := and{sel}
+	for p.isOp("&&") {
+		p.next()
+		if sel, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 1 {
+		return sels[0], nil
+	}
+	return sels, nil
+}
+
+func (p *parser) parseUnary() (Selector, error) {
+	switch {
+	case p.isOp("!"):
+		p.next()
+		sel, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not{sel}, nil
+	case p.isOp("("):
+		p.next()
+		sel, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return sel, p.expectOp(")")
+	case p.tok.kind == tokIdent:
+		return p.parseTerm()
+	}
+	return nil, p.unexpected("an expression")
+}
+
+// parseTerm a function call or a label operation
+func (p *parser) parseTerm() (Selector, error) {
+	ident := p.tok.text
+	p.next()
+	if p.isOp("(") {
+		p.next()
+		switch ident {
+		case "all", "global":
+			return all{}, p.expectOp(")")
+		case "has":
+			if p.tok.kind != tokIdent {
+				return nil, p.unexpected("a label key")
+			}
+			key := p.tok.text
+			p.next()
+			return has{key}, p.expectOp(")")
+		}
+		return nil, fmt.Errorf("unknown function %q", ident)
+	}
+
+	switch {
+	case p.isOp("==") || p.isOp("!="):
+		op := p.tok.text
+		p.next()
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return compare{key: ident, op: op, values: []string{value}}, nil
+	case p.isIdent("in"):
+		p.next()
+		values, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return compare{key: ident, op: "in", values: values}, nil
+	case p.isIdent("not"):
+		p.next()
+		if !p.isIdent("in") {
+			return nil, p.unexpected("\"in\"")
+		}
+		p.next()
+		values, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return compare{key: ident, op: "not in", values: values}, nil
+	case p.isIdent("contains"):
+		p.next()
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return compare{key: ident, op: "contains", values: []string{value}}, nil
+	case p.isIdent("starts") || p.isIdent("ends"):
+		op := p.tok.text + " with"
+		p.next()
+		if !p.isIdent("with") {
+			return nil, p.unexpected("\"with\"")
+		}
+		p.next()
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return compare{key: ident, op: op, values: []string{value}}, nil
+	}
+	return nil, p.unexpected("an operator")
+}
+
+func (p *parser) parseString() (string, error) {
+	if p.tok.kind != tokString {
+		return "", p.unexpected("a quoted string")
+	}
+	value := p.tok.text
+	p.next()
+	return value, p.err
+}
+
+func (p *parser) parseSet() ([]string, error) {
+	if err := p.expectOp("{"); err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for !p.isOp("}") {
+		if len(values) > 0 {
+			if err := p.expectOp(","); err != nil {
+				return nil, err
+			}
+		}
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	p.next()
+	return values, p.err
+}
@@ -0,0 +1,190 @@
+package selector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		selector string
+		// want the parsed selector in Calico syntax
+		want string
+	}{
+		{"", "all()"},
+		{"  ", "all()"},
+		{"all()", "all()"},
+		{"global()", "all()"},
+		{"has(zone)", "has(zone)"},
+		{"has( topology.kubernetes.io/zone )", "has(topology.kubernetes.io/zone)"},
+		{`zone == "a"`, `zone == "a"`},
+		{`zone == 'a'`, `zone == "a"`},
+		{`zone != "a"`, `zone != "a"`},
+		{`zone=="a"`, `zone == "a"`},
+		{`zone in {"a", "b"}`, `zone in {"a", "b"}`},
+		{`zone in {'a','b'}`, `zone in {"a", "b"}`},
+		{`zone in {}`, `zone in {}`},
+		{`zone not in {"a"}`, `zone not in {"a"}`},
+		{`zone contains "es"`, `zone contains "es"`},
+		{`zone starts with "eu-"`, `zone starts with "eu-"`},
+		{`zone ends with '-1'`, `zone ends with "-1"`},
+		{`zone == 'say "hi"'`, `zone == 'say "hi"'`},
+		{`zone == "it's"`, `zone == "it's"`},
+		{`!has(zone)`, `!has(zone)`},
+		{`!!has(zone)`, `!!has(zone)`},
+		// && binds tighter than ||
+		{`a == "1" || b == "2" && c == "3"`, `(a == "1" || (b == "2" && c == "3"))`},
+		{`a == "1" && b == "2" || c == "3"`, `((a == "1" && b == "2") || c == "3")`},
+		{`(a == "1" || b == "2") && c == "3"`, `((a == "1" || b == "2") && c == "3")`},
+		{`a == "1" && b == "2" && c == "3"`, `(a == "1" && b == "2" && c == "3")`},
+		// ! binds tighter than &&
+		{`!has(a) && has(b)`, `(!has(a) && has(b))`},
+		{`!(has(a) && has(b))`, `!(has(a) && has(b))`},
+	}
+	for _, tt := range tests {
+		sel, err := Parse(tt.selector)
+		if err != nil {
+			t.Errorf("Parse(%q) err: %v", tt.selector, err)
+			continue
+		}
+		if got := sel.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		selector string
+		// want a part of the error
+		want string
+	}{
+		{`zone == "a`, "unterminated string"},
+		{`zone == 'a`, "unterminated string"},
+		{`zone in {"a", 'b}`, "unterminated string"},
+		{`zone == "a" zone`, `unexpected "zone"`},
+		{`has(zone) )`, `unexpected ")"`},
+		{`has(zone) &&`, "expected an expression at end"},
+		{`|| has(zone)`, "expected an expression"},
+		{`zone`, "expected an operator at end"},
+		{`zone == a`, "expected a quoted string"},
+		{`zone =~ "a"`, `unexpected '='`},
+		{`zone not "a"`, `expected "in"`},
+		{`zone starts "a"`, `expected "with"`},
+		{`zone in "a"`, `expected "{"`},
+		{`zone in {"a" "b"}`, `expected ","`},
+		{`zone in {"a",}`, "expected a quoted string"},
+		{`zone in {"a"`, `expected "," at end`},
+		{`(has(zone)`, `expected ")" at end`},
+		{`has()`, "expected a label key"},
+		{`has(zone`, `expected ")" at end`},
+		{`label(zone)`, `unknown function "label"`},
+		{`zone == "a" # comment`, `unexpected '#'`},
+	}
+	for _, tt := range tests {
+		sel, err := Parse(tt.selector)
+		if err == nil {
+			t.Errorf("Parse(%q) = %s, want an error", tt.selector, sel)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) err: %v, want %q", tt.selector, err, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]string{
+		"zone": "eu-west-1",
+		"role": "worker",
+		"gpu":  "",
+	}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"all()", true},
+		{"has(zone)", true},
+		{"has(gpu)", true},
+		{"has(rack)", false},
+		{`zone == "eu-west-1"`, true},
+		{`zone == "eu-west-2"`, false},
+		{`gpu == ""`, true},
+		{`zone != "eu-west-1"`, false},
+		{`zone != "eu-west-2"`, true},
+		{`zone in {"eu-west-1", "eu-west-2"}`, true},
+		{`zone in {"eu-west-2"}`, false},
+		{`zone in {}`, false},
+		{`zone not in {"eu-west-1"}`, false},
+		{`zone not in {"eu-west-2"}`, true},
+		{`zone contains "west"`, true},
+		{`zone contains "east"`, false},
+		{`zone starts with "eu-"`, true},
+		{`zone starts with "us-"`, false},
+		{`zone ends with "-1"`, true},
+		{`zone ends with "-2"`, false},
+		// a missing label only matches the negative operators
+		{`rack == ""`, false},
+		{`rack != "r1"`, true},
+		{`rack != ""`, true},
+		{`rack in {"r1"}`, false},
+		{`rack not in {"r1"}`, true},
+		{`rack not in {}`, true},
+		{`rack contains ""`, false},
+		{`rack starts with ""`, false},
+		{`rack ends with ""`, false},
+		{`!has(rack)`, true},
+		{`!(rack == "r1")`, true},
+		{`has(zone) && role == "worker"`, true},
+		{`has(zone) && role == "master"`, false},
+		{`role == "master" || has(zone)`, true},
+		{`role == "master" || has(rack)`, false},
+		{`role == "master" || has(zone) && has(rack)`, false},
+		{`(role == "master" || has(zone)) && !has(rack)`, true},
+	}
+	for _, tt := range tests {
+		sel, err := Parse(tt.selector)
+		if err != nil {
+			t.Errorf("Parse(%q) err: %v", tt.selector, err)
+			continue
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("%q matches %v = %v, want %v", tt.selector, labels, got, tt.want)
+		}
+	}
+	sel, err := Parse(`rack != "r1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sel.Matches(nil) {
+		t.Errorf("%q does not match nil labels", sel)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	selectors := []string{
+		"all()",
+		"has(zone)",
+		`zone == "a" && role != 'b'`,
+		`zone in {"a", "b"} || zone not in {}`,
+		`!(zone contains "x" || zone starts with "y") && zone ends with "z"`,
+		`zone == 'say "hi"' || zone in {'"', "'"}`,
+		`!!has(a) && (has(b) || (has(c) && has(d)))`,
+	}
+	for _, selector := range selectors {
+		sel, err := Parse(selector)
+		if err != nil {
+			t.Errorf("Parse(%q) err: %v", selector, err)
+			continue
+		}
+		again, err := Parse(sel.String())
+		if err != nil {
+			t.Errorf("Parse(%q) of the String of %q err: %v", sel.String(), selector, err)
+			continue
+		}
+		if again.String() != sel.String() {
+			t.Errorf("String of %q not stable: %s then %s", selector, sel, again)
+		}
+	}
+}
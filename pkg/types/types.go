@@ -5,14 +5,47 @@ import (
 )
 
 const (
-	IPCmd    = "ip"
-	IpIpLink = "tunl0"
+	IPCmd     = "ip"
+	IpIpLink  = "tunl0"
+	VXLANLink = "vxlan.calico"
+
+	// DefaultVXLANVNI DefaultVXLANPort the defaults of Calico's ipv4 vxlan overlay
+	DefaultVXLANVNI  = 4096
+	DefaultVXLANPort = 4789
+
+	// DefaultRouteProtocol rtnetlink protocol marking the routes installed by calico-route-sync
+	DefaultRouteProtocol = 77
+	// DefaultRulePriority priority of the ip rules looking up a dedicated route table
+	DefaultRulePriority = 1000
+)
+
+const (
+	// EncapAlways EncapCrossSubnet EncapNever the IPIPMode/VXLANMode values of a Calico IPPool
+	EncapAlways      = "Always"
+	EncapCrossSubnet = "CrossSubnet"
+	EncapNever       = "Never"
 )
 
 // Route route info
 type Route struct {
 	DstNet *net.IPNet
 	GwIP   net.IP
+	// IPIPMode the IPIPMode of the pool of DstNet
+	IPIPMode string
+	// VXLANMode the VXLANMode of the pool of DstNet
+	VXLANMode string
+	// VTEP the vxlan tunnel endpoint of the node, nil if the node has none
+	VTEP *VTEP
+}
+
+// VTEP vxlan tunnel endpoint of a node
+type VTEP struct {
+	// TunnelIP the address of the vxlan device of the node, used as the route gateway
+	TunnelIP net.IP
+	// MAC the mac of the vxlan device of the node
+	MAC net.HardwareAddr
+	// NodeIP the underlay address the vxlan packets are sent to
+	NodeIP net.IP
 }
 
 type IP4 struct {
@@ -20,10 +53,38 @@ type IP4 struct {
 	IP  net.IP
 }
 
+type IP6 struct {
+	Net *net.IPNet
+	IP  net.IP
+}
+
 // LocalNetwork local network
 type LocalNetwork struct {
 	LinkName string
 	LocalIp4 []IP4
+	LocalIp6 []IP6
 	//LocalIP  net.IP
 	//LocalNet *net.IPNet
 }
+
+// Contains Whether ip is in one of the subnets directly connected to the link,
+// only the addresses of the same family as ip are considered
+func (n LocalNetwork) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.To4() != nil {
+		for _, ip4 := range n.LocalIp4 {
+			if ip4.Net.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ip6 := range n.LocalIp6 {
+		if ip6.Net.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
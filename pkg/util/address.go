@@ -0,0 +1,112 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	coreapiv1 "k8s.io/api/core/v1"
+)
+
+// AddressSourceCalico the address calico/node peers and routes on, read from the projectcalico.org/IPv4Address
+// (IPv6Address) annotation it publishes on the Kubernetes node. The Calico Node resource is not read
+const AddressSourceCalico = "calico"
+
+// DefaultAddressSources prefer calico's own address, fall back to the InternalIP
+var DefaultAddressSources = []string{AddressSourceCalico, string(coreapiv1.NodeInternalIP)}
+
+// NodeAddressPolicy how the address of a node used as gateway is selected
+type NodeAddressPolicy struct {
+	// Sources ordered list of AddressSourceCalico and kubernetes node address types, empty means InternalIP
+	Sources []string
+	// LocalSubnet prefer the first address inside one of the local subnets, whatever its source
+	LocalSubnet bool
+}
+
+// ParseAddressSources parse a comma separated list of address sources
+func ParseAddressSources(s string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(s, ",") {
+		source = strings.TrimSpace(source)
+		switch coreapiv1.NodeAddressType(source) {
+		case AddressSourceCalico, coreapiv1.NodeInternalIP, coreapiv1.NodeExternalIP,
+			coreapiv1.NodeInternalDNS, coreapiv1.NodeExternalDNS, coreapiv1.NodeHostName:
+			sources = append(sources, source)
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid node address source %q", source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no node address source")
+	}
+	return sources, nil
+}
+
+// NodeIP the address of the given family (netlink.FAMILY_V4 or netlink.FAMILY_V6) selected by the policy
+func (p NodeAddressPolicy) NodeIP(node *coreapiv1.Node, family int, localNetworks []types.LocalNetwork) net.IP {
+	candidates := p.candidates(node, family)
+	if len(candidates) == 0 {
+		return nil
+	}
+	if p.LocalSubnet {
+		for _, ip := range candidates {
+			for _, network := range localNetworks {
+				if network.Contains(ip) {
+					return ip
+				}
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// candidates the addresses of the family in the order of the sources
+func (p NodeAddressPolicy) candidates(node *coreapiv1.Node, family int) []net.IP {
+	sources := p.Sources
+	if len(sources) == 0 {
+		sources = []string{string(coreapiv1.NodeInternalIP)}
+	}
+	var ips []net.IP
+	for _, source := range sources {
+		if source == AddressSourceCalico {
+			if ip := calicoAddress(node, family); ip != nil {
+				ips = append(ips, ip)
+			}
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if string(address.Type) != source {
+				continue
+			}
+			ip := net.ParseIP(address.Address)
+			if ip != nil && IPFamily(ip) == family {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// calicoAddress the address of the family calico/node published on the node, nil if none
+func calicoAddress(node *coreapiv1.Node, family int) net.IP {
+	key := calico.AnnotationIPv4Address
+	if family == netlink.FAMILY_V6 {
+		key = calico.AnnotationIPv6Address
+	}
+	value := node.Annotations[key]
+	if value == "" {
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(value)
+	if err != nil {
+		ip = net.ParseIP(value)
+	}
+	if ip == nil || IPFamily(ip) != family {
+		return nil
+	}
+	return ip
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
+	"github.com/yzxiu/calico-route-sync/pkg/types"
+	coreapiv1 "k8s.io/api/core/v1"
+)
+
+func TestNodeAddressPolicy(t *testing.T) {
+	node := &coreapiv1.Node{}
+	node.Annotations = map[string]string{
+		calico.AnnotationIPv4Address: "10.0.1.5/24",
+		calico.AnnotationIPv6Address: "fd00:1::5",
+	}
+	node.Status.Addresses = []coreapiv1.NodeAddress{
+		{Type: coreapiv1.NodeHostName, Address: "node-1"},
+		{Type: coreapiv1.NodeInternalIP, Address: "192.168.0.5"},
+		{Type: coreapiv1.NodeInternalIP, Address: "fd00:2::5"},
+		{Type: coreapiv1.NodeExternalIP, Address: "203.0.113.5"},
+	}
+	bare := &coreapiv1.Node{}
+	bare.Annotations = map[string]string{
+		// an annotation of the other family or unparsable is ignored
+		calico.AnnotationIPv4Address: "fd00:1::5",
+		calico.AnnotationIPv6Address: "not an address",
+	}
+	bare.Status.Addresses = []coreapiv1.NodeAddress{{Type: coreapiv1.NodeInternalIP, Address: "192.168.0.6"}}
+	local := []types.LocalNetwork{{
+		LinkName: "eth1",
+		LocalIp4: []types.IP4{{Net: ParseNet("203.0.113.0/24"), IP: net.ParseIP("203.0.113.1")}},
+	}}
+
+	tests := []struct {
+		name   string
+		policy NodeAddressPolicy
+		node   *coreapiv1.Node
+		family int
+		local  []types.LocalNetwork
+		want   string
+	}{
+		{"default InternalIP v4", NodeAddressPolicy{}, node, netlink.FAMILY_V4, nil, "192.168.0.5"},
+		{"default InternalIP v6", NodeAddressPolicy{}, node, netlink.FAMILY_V6, nil, "fd00:2::5"},
+		{"calico annotation v4", NodeAddressPolicy{Sources: DefaultAddressSources}, node, netlink.FAMILY_V4, nil, "10.0.1.5"},
+		{"calico annotation v6", NodeAddressPolicy{Sources: DefaultAddressSources}, node, netlink.FAMILY_V6, nil, "fd00:1::5"},
+		{"calico annotation of the other family", NodeAddressPolicy{Sources: DefaultAddressSources}, bare, netlink.FAMILY_V4, nil, "192.168.0.6"},
+		{"calico annotation invalid", NodeAddressPolicy{Sources: []string{AddressSourceCalico}}, bare, netlink.FAMILY_V6, nil, ""},
+		{"source order", NodeAddressPolicy{Sources: []string{"ExternalIP", "InternalIP"}}, node, netlink.FAMILY_V4, nil, "203.0.113.5"},
+		{"hostname is no address", NodeAddressPolicy{Sources: []string{"Hostname"}}, node, netlink.FAMILY_V4, nil, ""},
+		{"no address of the family", NodeAddressPolicy{Sources: []string{"ExternalIP"}}, node, netlink.FAMILY_V6, nil, ""},
+		{"no local candidate", NodeAddressPolicy{Sources: DefaultAddressSources, LocalSubnet: true}, node, netlink.FAMILY_V4, local,
+			"10.0.1.5"},
+		{"local subnet of a later source", NodeAddressPolicy{Sources: []string{"calico", "ExternalIP"}, LocalSubnet: true}, node,
+			netlink.FAMILY_V4, local, "203.0.113.5"},
+		{"no local network of the family", NodeAddressPolicy{Sources: DefaultAddressSources, LocalSubnet: true}, node, netlink.FAMILY_V6,
+			local, "fd00:1::5"},
+	}
+	for _, tt := range tests {
+		got := tt.policy.NodeIP(tt.node, tt.family, tt.local)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s: NodeIP = %s, want none", tt.name, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: NodeIP = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddressSources(t *testing.T) {
+	tests := []struct {
+		sources string
+		want    []string
+		err     bool
+	}{
+		{"calico,InternalIP", []string{"calico", "InternalIP"}, false},
+		{" ExternalIP , calico ,", []string{"ExternalIP", "calico"}, false},
+		{"Hostname", []string{"Hostname"}, false},
+		{"", nil, true},
+		{" , ", nil, true},
+		{"calico,PublicIP", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddressSources(tt.sources)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseAddressSources(%q) err: %v, want error %v", tt.sources, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseAddressSources(%q) = %v, want %v", tt.sources, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseAddressSources(%q) = %v, want %v", tt.sources, got, tt.want)
+				break
+			}
+		}
+	}
+}
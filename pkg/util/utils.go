@@ -4,9 +4,11 @@ import (
 	"errors"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"github.com/yzxiu/calico-route-sync/pkg/calico"
 	"github.com/yzxiu/calico-route-sync/pkg/types"
 	coreapiv1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
+	"math/big"
 	"net"
 )
 
@@ -31,7 +33,7 @@ func LocalNetworks() ([]types.LocalNetwork, error) {
 		}
 		network, err := parseNetwork(n)
 		if err != nil {
-			klog.Warningf("[%s] can not find ipv4 address", link.Attrs().Name)
+			klog.Warningf("[%s] can not find ipv4 or ipv6 address", link.Attrs().Name)
 			continue
 		}
 		networks = append(networks, *network)
@@ -47,36 +49,62 @@ func parseNetwork(inter *net.Interface) (*types.LocalNetwork, error) {
 	if err != nil {
 		return nil, err
 	}
-	var ips []types.IP4
+	var ip4s []types.IP4
+	var ip6s []types.IP6
 	for _, add := range adds {
 		ip, ipNet, err := net.ParseCIDR(add.String())
 		if err != nil {
 			continue
 		}
 		if ip.To4() != nil {
-			ips = append(ips, types.IP4{
+			ip4s = append(ip4s, types.IP4{
 				IP:  ip,
 				Net: ipNet,
 			})
+			continue
+		}
+		// link-local addresses can not be used to reach the nodes
+		if ip.IsLinkLocalUnicast() {
+			continue
 		}
+		ip6s = append(ip6s, types.IP6{
+			IP:  ip,
+			Net: ipNet,
+		})
 	}
-	if len(ips) == 0 {
-		return nil, errors.New("can not find ipv4 address")
+	if len(ip4s) == 0 && len(ip6s) == 0 {
+		return nil, errors.New("can not find ipv4 or ipv6 address")
 	}
 	return &types.LocalNetwork{
 		LinkName: inter.Name,
-		LocalIp4: ips,
+		LocalIp4: ip4s,
+		LocalIp6: ip6s,
 	}, nil
 }
 
-// NodeInternalIP get node ip
-func NodeInternalIP(node *coreapiv1.Node) net.IP {
-	for _, address := range node.Status.Addresses {
-		if address.Type == "InternalIP" {
-			return net.ParseIP(address.Address)
-		}
+// NodeVTEP the ipv4 vxlan tunnel endpoint calico/node published on the node, nil if it has none
+func NodeVTEP(node *coreapiv1.Node, nodeIP net.IP) *types.VTEP {
+	if nodeIP == nil || nodeIP.To4() == nil {
+		return nil
+	}
+	tunnelIP := net.ParseIP(node.Annotations[calico.AnnotationIPv4VXLANTunnelAddr])
+	mac, err := net.ParseMAC(node.Annotations[calico.AnnotationVXLANTunnelMACAddr])
+	if tunnelIP == nil || tunnelIP.To4() == nil || err != nil {
+		return nil
 	}
-	return nil
+	return &types.VTEP{
+		TunnelIP: tunnelIP,
+		MAC:      mac,
+		NodeIP:   nodeIP,
+	}
+}
+
+// IPFamily get the netlink family of ip
+func IPFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
 }
 
 // ParseNet parse IPNet
@@ -97,3 +125,40 @@ func ContainsCIDR(a, b *net.IPNet) bool {
 	ones2, _ := b.Mask.Size()
 	return ones1 <= ones2 && a.Contains(b.IP)
 }
+
+// ContainedInAny Whether b is a subnet of one of nets
+func ContainedInAny(nets []net.IPNet, b *net.IPNet) bool {
+	for i := range nets {
+		if ContainsCIDR(&nets[i], b) {
+			return true
+		}
+	}
+	return false
+}
+
+// NthIP the n-th address of the subnet
+func NthIP(subnet *net.IPNet, n int) net.IP {
+	ip := subnet.IP.To4()
+	if ip == nil {
+		ip = subnet.IP.To16()
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(ip), big.NewInt(int64(n)))
+	bytes := sum.Bytes()
+	if len(bytes) > len(ip) {
+		return nil
+	}
+	result := make(net.IP, len(ip))
+	copy(result[len(ip)-len(bytes):], bytes)
+	if !subnet.Contains(result) {
+		return nil
+	}
+	return result
+}
+
+// HostNet the /32 (/128) subnet of ip
+func HostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}